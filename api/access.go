@@ -0,0 +1,258 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+const (
+	// accessCallback prefixes the data of the buttons of the access window
+	// picker.
+	accessCallback = "access"
+	// accessPickerStep is the granularity of the minutes of the picker.
+	accessPickerStep = 15
+
+	noAccessWindow = "🚫 Nessuna fascia fissa"
+)
+
+// accessWindowRegexp matches a window such as "8:00 - 9:30", "08.00-09.30"
+// or "8:00–9:30".
+var accessWindowRegexp = regexp.MustCompile(`^(\d{1,2}[:.]\d{2})\s*[-–—]\s*(\d{1,2}[:.]\d{2})$`)
+
+// hasAccessWindow reports whether user has a fixed access window.
+func hasAccessWindow(user *types.User) bool {
+	return !user.AccessEnd.IsZero()
+}
+
+// formatAccessWindow describes the access window of user, e.g.
+// "08:00 - 09:30".
+func formatAccessWindow(user *types.User) string {
+	if !hasAccessWindow(user) {
+		return tr(user, "nessuna")
+	}
+	return fmt.Sprintf("%s - %s", user.AccessStart.Format("15:04"), user.AccessEnd.Format("15:04"))
+}
+
+// parseAccessWindow parses a window such as "8:00 - 9:30" as the durations
+// since midnight of its start and end.
+func parseAccessWindow(s string) (time.Duration, time.Duration, error) {
+	matches := accessWindowRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if matches == nil {
+		return 0, 0, errInvalidDuration
+	}
+	start, err := parseClock(matches[1])
+	if err != nil || start >= 24*time.Hour {
+		return 0, 0, errInvalidDuration
+	}
+	end, err := parseClock(matches[2])
+	if err != nil || end >= 24*time.Hour {
+		return 0, 0, errInvalidDuration
+	}
+	return start, end, nil
+}
+
+func handleUserSetupAccessTime(user *types.User, msg *tgbotapi.Message) error {
+	if msg == nil {
+		var text string
+		switch user.State {
+		case types.UserSetupAccessTime:
+			text = tr(user, "Per ultimo, scegli la fascia oraria in cui entri al lavoro.")
+		case types.SetAccessTime:
+			text = tr(user, "Per favore, scegli la fascia oraria in cui entri al lavoro.")
+		default:
+			return unexpectedState(user)
+		}
+		mc := createReply(user, "%s Inizia dall'ora con i pulsanti oppure scrivimela, ad esempio 8:00 - 9:30. Se non hai un orario d'ingresso fisso, premi %s.", text, tr(user, noAccessWindow))
+		mc.ReplyMarkup = accessHourKeyboard(user, "", 0)
+		return send(mc)
+	}
+
+	text := strings.TrimSpace(msg.Text)
+	if isButton(user, text, noAccessWindow) || strings.EqualFold(text, "nessuna") || strings.EqualFold(text, tr(user, "nessuna")) {
+		return setAccessWindow(user, time.Time{}, time.Time{})
+	}
+
+	start, end, err := parseAccessWindow(text)
+	if err != nil {
+		return reply(user, "Non riesco a capire cosa hai scritto, scrivimi la fascia oraria ad esempio come 8:00 - 9:30.")
+	}
+	if start >= end {
+		return reply(user, "L'inizio della fascia oraria deve precedere la fine, prova di nuovo.")
+	}
+	return setAccessWindow(user, clockTime(start), clockTime(end))
+}
+
+// setAccessWindow saves the access window of user, which has none if start
+// and end are zero, and goes back to the main menu.
+func setAccessWindow(user *types.User, start, end time.Time) error {
+	setup := user.State == types.UserSetupAccessTime
+	user.AccessStart = start
+	user.AccessEnd = end
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	if hasAccessWindow(user) {
+		err = reply(user, "Grazie! Hai scelto la fascia oraria %s.", formatAccessWindow(user))
+	} else {
+		err = reply(user, "Va bene, non hai una fascia oraria d'ingresso fissa: non ti ricorderò di timbrare l'ingresso né segnalerò i ritardi.")
+	}
+	if err != nil {
+		return err
+	}
+	if setup {
+		err = reply(user, "Congratulazioni %s, ora puoi iniziare ad usare Workbot!", user.FirstName)
+		if err != nil {
+			return err
+		}
+	}
+	return handleMessage(user, nil)
+}
+
+// accessHourKeyboard offers the hours from the given one on, under the
+// prefix of the fields chosen so far.
+func accessHourKeyboard(user *types.User, prefix string, from int) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+	for h := from; h < 24; h++ {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%02d", h), accessData(prefix, fmt.Sprintf("%02d", h))))
+		if len(row) == 6 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	if prefix == "" {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(tr(user, noAccessWindow), accessData("", "none"))))
+	}
+	return withAccessCancel(user, rows)
+}
+
+// accessMinuteKeyboard offers the minutes after the given ones and before
+// until, under the prefix of the fields chosen so far.
+func accessMinuteKeyboard(user *types.User, prefix string, after int, until int) tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	for m := 0; m < until; m += accessPickerStep {
+		if m > after {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf(":%02d", m), accessData(prefix, fmt.Sprintf("%02d", m))))
+		}
+	}
+	return withAccessCancel(user, [][]tgbotapi.InlineKeyboardButton{row})
+}
+
+// withAccessCancel adds a button to cancel the picker from the settings;
+// during the setup the window has to be chosen.
+func withAccessCancel(user *types.User, rows [][]tgbotapi.InlineKeyboardButton) tgbotapi.InlineKeyboardMarkup {
+	if user.State != types.UserSetupAccessTime {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(tr(user, back), accessData("", "cancel"))))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// accessData builds the data of a button of the access window picker.
+func accessData(prefix string, field string) string {
+	if prefix == "" {
+		return accessCallback + "|" + field
+	}
+	return accessCallback + "|" + prefix + "|" + field
+}
+
+// handleAccessCallback moves the access window picker a step forward, from
+// the start hour and minutes to the end ones, then saves the window.
+func handleAccessCallback(user *types.User, cq *tgbotapi.CallbackQuery) error {
+	fields := strings.Split(cq.Data, "|")[1:]
+	chatId, messageId := cq.Message.Chat.ID, cq.Message.MessageID
+
+	if user.State != types.SetAccessTime && user.State != types.UserSetupAccessTime {
+		// The window has been chosen in the meantime
+		return send(tgbotapi.NewEditMessageText(chatId, messageId, tr(user, "Operazione annullata.")))
+	}
+
+	switch fields[0] {
+	case "cancel":
+		err := send(tgbotapi.NewEditMessageText(chatId, messageId, tr(user, "Operazione annullata.")))
+		if err != nil {
+			return err
+		}
+		user.State = types.Main
+		err = userdb.UpdateUser(user)
+		if err != nil {
+			return err
+		}
+		return handleMessage(user, nil)
+	case "none":
+		err := send(tgbotapi.NewEditMessageText(chatId, messageId, tr(user, "Nessuna fascia oraria d'ingresso fissa.")))
+		if err != nil {
+			return err
+		}
+		return setAccessWindow(user, time.Time{}, time.Time{})
+	}
+
+	var values []int
+	for _, f := range fields {
+		v, err := strconv.Atoi(f)
+		if err != nil || v < 0 || v > 59 || len(values)%2 == 0 && v > 23 {
+			return unexpectedCallback(cq)
+		}
+		values = append(values, v)
+	}
+	prefix := strings.Join(fields, "|")
+
+	var text string
+	var kb tgbotapi.InlineKeyboardMarkup
+	switch len(values) {
+	case 1:
+		text = trf(user, "Inizio della fascia oraria alle %02d: e i minuti?", values[0])
+		// The window has to end within the day, at 23:45 at the latest
+		until := 60
+		if values[0] == 23 {
+			until -= accessPickerStep
+		}
+		kb = accessMinuteKeyboard(user, prefix, -1, until)
+	case 2:
+		text = trf(user, "Inizio della fascia oraria alle %02d:%02d: a che ora finisce?", values[0], values[1])
+		from := values[0]
+		if values[1]+accessPickerStep >= 60 {
+			from++
+		}
+		if from > 23 {
+			return unexpectedCallback(cq)
+		}
+		kb = accessHourKeyboard(user, prefix, from)
+	case 3:
+		text = trf(user, "Fascia oraria dalle %02d:%02d alle %02d: e i minuti?", values[0], values[1], values[2])
+		after := -1
+		if values[2] == values[0] {
+			after = values[1]
+		}
+		kb = accessMinuteKeyboard(user, prefix, after, 60)
+	case 4:
+		start := time.Duration(values[0])*time.Hour + time.Duration(values[1])*time.Minute
+		end := time.Duration(values[2])*time.Hour + time.Duration(values[3])*time.Minute
+		if start >= end {
+			return unexpectedCallback(cq)
+		}
+		err := send(tgbotapi.NewEditMessageText(chatId, messageId, trf(user, "Fascia oraria dalle %s alle %s.", clockTime(start).Format("15:04"), clockTime(end).Format("15:04"))))
+		if err != nil {
+			return err
+		}
+		return setAccessWindow(user, clockTime(start), clockTime(end))
+	default:
+		return unexpectedCallback(cq)
+	}
+
+	mc := tgbotapi.NewEditMessageText(chatId, messageId, text)
+	mc.ReplyMarkup = &kb
+	return send(mc)
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+func TestAccessPickerHasNoDeadEnds(t *testing.T) {
+	openTestDB(t)
+
+	api := &fakeBotAPI{}
+	apiSrv := httptest.NewServer(api)
+	defer apiSrv.Close()
+	err := NewTelegramBot("token", apiSrv.URL, false)
+	if err != nil {
+		t.Fatalf("could not start the bot: %s", err)
+	}
+
+	user := types.NewUser()
+	user.Id = 42
+	user.TimeZone = "Europe/Rome"
+	user.State = types.SetAccessTime
+	err = userdb.InsertUser(user)
+	if err != nil {
+		t.Fatalf("could not insert the user: %s", err)
+	}
+
+	// choices returns the data of the buttons moving the picker forward
+	choices := func(kb tgbotapi.InlineKeyboardMarkup) []string {
+		var data []string
+		for _, row := range kb.InlineKeyboard {
+			for _, b := range row {
+				if d := *b.CallbackData; d != accessData("", "none") && d != accessData("", "cancel") {
+					data = append(data, d)
+				}
+			}
+		}
+		return data
+	}
+
+	// Every start and end hour leads to at least a choice of minutes, up
+	// to the end minutes which save the window
+	pending := choices(accessHourKeyboard(user, "", 0))
+	for len(pending) > 0 {
+		data := pending[0]
+		pending = pending[1:]
+
+		cq := &tgbotapi.CallbackQuery{
+			Data:    data,
+			Message: &tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: 42}},
+		}
+		err := handleAccessCallback(user, cq)
+		if err != nil {
+			t.Fatalf("%s: %s", data, err)
+		}
+
+		api.mu.Lock()
+		markup := api.markups[len(api.markups)-1]
+		api.mu.Unlock()
+		var kb tgbotapi.InlineKeyboardMarkup
+		err = json.Unmarshal([]byte(markup), &kb)
+		if err != nil {
+			t.Fatalf("%s: could not decode the keyboard %q: %s", data, markup, err)
+		}
+		next := choices(kb)
+		if len(next) == 0 {
+			t.Errorf("%s: no way forward", data)
+		}
+		// Stop before the end minutes, which would save the window
+		if strings.Count(data, "|") < 3 {
+			pending = append(pending, next...)
+		}
+	}
+}
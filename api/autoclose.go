@@ -0,0 +1,280 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	autoClosePollInterval = 5 * time.Minute
+	// closeNoticeHour is the hour of the morning the users are told about
+	// the days closed overnight.
+	closeNoticeHour = 9
+	// closeNoticePrefix prefixes the names of the reminders telling the
+	// users about a day whose exit has been forgotten.
+	closeNoticePrefix = "closed:"
+
+	autoExitNote    = "Uscita automatica"
+	missingExitNote = "Uscita mancante"
+
+	leaveOpen              = "Lascia aperta"
+	closeAtTheoreticalExit = "Chiudi all'uscita teorica"
+	closeAtFormat          = "Chiudi alle %s"
+)
+
+// closeAtRegexp matches a time, possibly preceded by the label of its
+// button, e.g. "Chiudi alle 18:00".
+var closeAtRegexp = regexp.MustCompile(`^\D*(\d{1,2}[:.]\d{2})$`)
+
+// closingTime returns when the open interval of record is closed according
+// to the close policy of user.
+func closingTime(user *types.User, record *types.Record) time.Time {
+	enter := record.Intervals[len(record.Intervals)-1].Enter
+
+	t := record.TheoreticalExit(user.WorkDuration(record.Enter()))
+	if user.ClosePolicy == types.CloseAtFixedTime {
+		h, m, _ := user.CloseTime.Clock()
+		t = time.Date(enter.Year(), enter.Month(), enter.Day(), h, m, 0, 0, enter.Location())
+		if !t.After(enter) {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+
+	// The user may have come back after the theoretical exit
+	if t.Before(enter) {
+		return enter
+	}
+	return t
+}
+
+// isForgotten reports whether the exit of record has been forgotten as of
+// now, i.e. the day it should have been closed on is over.
+func isForgotten(user *types.User, record *types.Record, now time.Time) bool {
+	if len(record.Intervals) == 0 || record.HasExit() {
+		return false
+	}
+	t := closingTime(user, record)
+	return !now.Before(time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+}
+
+// runAutoClose handles the forgotten exits until stop is closed.
+func runAutoClose(d *dispatcher, stop <-chan struct{}) {
+	runScheduler(d, stop, autoClosePollInterval, userdb.GetUserIds, autoClose)
+}
+
+// autoClose applies the close policy to the last day of the user with the
+// given ID, if its exit has been forgotten, then tells the user about the
+// days closed overnight.
+func autoClose(id int) {
+	log := logrus.WithField("user", id)
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic while closing forgotten exits: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	user, err := userdb.GetUser(id)
+	if err != nil {
+		log.Errorf("Could not get user: %s", err.Error())
+		return
+	}
+	if !isSetUp(user) {
+		return
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		log.Errorf("Could not load time zone: %s", err.Error())
+		return
+	}
+	now := time.Now().In(loc)
+
+	err = closeForgottenDay(user, now)
+	if err != nil {
+		log.Errorf("Could not close forgotten exit: %s", err.Error())
+		return
+	}
+
+	err = sendCloseNotices(user, now)
+	if needsAuthorization(err) {
+		// The notices are sent once the user authorizes the access again
+		return
+	}
+	if e, ok := err.(*telegramError); ok && e.isBlocked() {
+		log.Infof("User cannot be reached: %s", err.Error())
+	} else if err != nil {
+		log.Errorf("Could not send close notices: %s", err.Error())
+	}
+}
+
+// closeForgottenDay closes the open interval of user, if its exit has been
+// forgotten as of now, and schedules the notice for the morning. With the
+// LeaveOpen policy, the day is only flagged in the timesheet.
+func closeForgottenDay(user *types.User, now time.Time) error {
+	last, err := userdb.GetLastEvent(user.Id, now)
+	if err == sql.ErrNoRows || err == nil && last.Kind != types.EnterEvent {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	records, err := monthRecords(user, last.Time)
+	if err != nil {
+		return err
+	}
+	record := findRecord(records, last.Time.In(now.Location()).Format("2006-01-02"))
+	if record == nil || !isForgotten(user, record, now) {
+		return nil
+	}
+
+	name := closeNoticePrefix + record.Date
+	_, err = userdb.GetReminder(user.Id, name)
+	if err != sql.ErrNoRows {
+		// Already handled
+		return err
+	}
+
+	if user.ClosePolicy != types.LeaveOpen {
+		event := types.NewEvent(user.Id, types.ExitEvent, closingTime(user, record))
+		event.RecordedBy = types.WorkBot
+		err = userdb.AppendEvent(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Mark the day in the timesheet; a night shift belongs to the day it
+	// started
+	err = enqueueSync(user, record.Enter())
+	if err != nil {
+		return err
+	}
+
+	notice := time.Date(now.Year(), now.Month(), now.Day(), closeNoticeHour, 0, 0, 0, now.Location())
+	if notice.Before(now) {
+		notice = now
+	}
+	return userdb.SaveReminder(&types.Reminder{UserId: user.Id, Name: name, SnoozedUntil: notice})
+}
+
+// sendCloseNotices tells user about the days whose exit has been
+// forgotten, unless they have been corrected in the meantime.
+func sendCloseNotices(user *types.User, now time.Time) error {
+	notices, err := userdb.GetSnoozedReminders(user.Id, closeNoticePrefix, now)
+	if err != nil {
+		return err
+	}
+
+	for i := range notices {
+		n := &notices[i]
+		date := strings.TrimPrefix(n.Name, closeNoticePrefix)
+		day, err := time.ParseInLocation("2006-01-02", date, now.Location())
+		if err != nil {
+			return err
+		}
+
+		records, err := monthRecords(user, day)
+		if err != nil {
+			return err
+		}
+		record := findRecord(records, date)
+		when := strings.Title(formatPunchDay(user, day, now))
+		example := "/exit " + day.Format("02/01") + " 18:00"
+
+		switch {
+		case record == nil || record.HasExit() && !record.Intervals[len(record.Intervals)-1].AutoExit:
+			// Corrected by the user
+		case record.HasExit():
+			err = reply(user, "%s non hai timbrato l'uscita: l'ho registrata io alle %s. Se non è corretta, correggila ad esempio con %s.",
+				when, formatSheetTime(record.Exit(), day), example)
+		default:
+			err = reply(user, "%s non hai timbrato l'uscita e la giornata è rimasta aperta. Registrala ad esempio con %s.",
+				when, example)
+		}
+		if err != nil {
+			return err
+		}
+
+		n.SentAt = now
+		n.SnoozedUntil = time.Time{}
+		err = userdb.SaveReminder(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closePolicyName describes the close policy of user.
+func closePolicyName(user *types.User) string {
+	switch user.ClosePolicy {
+	case types.CloseAtTheoreticalExit:
+		return tr(user, "uscita teorica")
+	case types.CloseAtFixedTime:
+		return trf(user, "alle %s", user.CloseTime.Format("15:04"))
+	}
+	return tr(user, "lascia aperta")
+}
+
+func handleSetClosePolicy(user *types.User, msg *tgbotapi.Message) error {
+	if msg == nil {
+		kb := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(tr(user, leaveOpen)),
+				tgbotapi.NewKeyboardButton(tr(user, closeAtTheoreticalExit)),
+			),
+		)
+		row := tgbotapi.NewKeyboardButtonRow()
+		for h := 17; h <= 20; h++ {
+			row = append(row, tgbotapi.NewKeyboardButton(trf(user, closeAtFormat, fmt.Sprintf("%02d:00", h))))
+		}
+		kb.Keyboard = append(kb.Keyboard, row)
+		kb.OneTimeKeyboard = true
+		mc := createReply(user, "Cosa devo fare se dimentichi di timbrare l'uscita? A fine giornata posso lasciarla aperta, chiuderla all'uscita teorica o a un orario fisso, che puoi anche scrivermi (ad esempio 18:30). In ogni caso te lo segnalerò la mattina dopo.")
+		mc.ReplyMarkup = kb
+		return send(mc)
+	}
+
+	switch text := strings.TrimSpace(msg.Text); {
+	case isButton(user, text, leaveOpen):
+		user.ClosePolicy = types.LeaveOpen
+	case isButton(user, text, closeAtTheoreticalExit):
+		user.ClosePolicy = types.CloseAtTheoreticalExit
+	case closeAtRegexp.MatchString(text):
+		t, err := time.Parse("15:04", strings.Replace(closeAtRegexp.FindStringSubmatch(text)[1], ".", ":", 1))
+		if err != nil {
+			return reply(user, "Non riesco a capire l'orario, prova di nuovo.")
+		}
+		user.ClosePolicy = types.CloseAtFixedTime
+		user.CloseTime = t
+	default:
+		return reply(user, "Non riesco a capire cosa hai scritto, prova di nuovo.")
+	}
+
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	if user.ClosePolicy == types.LeaveOpen {
+		err = reply(user, "Fatto! Se dimentichi l'uscita lascerò la giornata aperta e te lo segnalerò.")
+	} else {
+		err = reply(user, "Fatto! Se dimentichi l'uscita la registrerò io (%s) e te lo segnalerò.", closePolicyName(user))
+	}
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
@@ -0,0 +1,226 @@
+package api
+
+// englishCatalog translates the messages into English.
+var englishCatalog = map[string]string{
+	// Buttons
+	backendGoogleSheets:         "📊 Google Sheets",
+	backendLocal:                "💾 Only on WorkBot",
+	changeAccessTimeFormat:      "🕙 Change entry time (%s)",
+	changeAccessTime:            "🕙 Change entry time",
+	changeClosePolicyFormat:     "🌙 End of day (%s)",
+	changeClosePolicy:           "🌙 End of day",
+	changeDigestFormat:          "📬 Automatic summary (%s)",
+	changeDigest:                "📬 Automatic summary",
+	changeHolidaysFormat:        "🎉 Holidays (%s)",
+	changeHolidays:              "🎉 Holidays",
+	changeExtraWorkFormat:       "➕ Overtime threshold (from %s)",
+	changeExtraWork:             "➕ Overtime threshold",
+	changeLanguageFormat:        "🌐 Language (%s)",
+	changeLanguage:              "🌐 Language",
+	changeLocationFormat:        "🌍 Change time zone (%s)",
+	changeLocation:              "🌍 Change time zone",
+	changeSchedule:              "📅 Weekly schedule",
+	changeWorkDayFormat:         "⏱ Work day (%s)",
+	changeWorkDay:               "⏱ Work day",
+	closeAtFormat:               "Close at %s",
+	closeAtTheoreticalExit:      "Close at the theoretical exit",
+	editPunch:                   "🕘 Correct",
+	editSettings:                "🔧 Settings",
+	leaveOpen:                   "Leave open",
+	noAccessWindow:              "🚫 No fixed window",
+	scheduleDone:                "✅ Done",
+	sendLocation:                "🌍 Send location",
+	workEnd:                     "Exit",
+	workStart:                   "Entry",
+	"↩️ Annulla":                "↩️ Undo",
+	"✅ Timbra l'ingresso":       "✅ Clock in",
+	"✅ Timbra l'uscita":         "✅ Clock out",
+	"⏰ Tra %d minuti":           "⏰ In %d minutes",
+	"📅 Settimana":               "📅 Week",
+	"🗓 Mese":                    "🗓 Month",
+	"🔑 Autorizza Google Sheets": "🔑 Authorize Google Sheets",
+
+	// Words
+	"nessuna":        "none",
+	"nessuno":        "none",
+	"oggi":           "today",
+	"ieri":           "yesterday",
+	"il %s":          "on %s",
+	"alle %s":        "at %s",
+	"uscita teorica": "theoretical exit",
+	"lascia aperta":  "leave open",
+	"settimanale":    "weekly",
+	"mensile":        "monthly",
+	"italiane":       "italian",
+	dayOff:           "off",
+	"lunedì":         "monday",
+	"martedì":        "tuesday",
+	"mercoledì":      "wednesday",
+	"giovedì":        "thursday",
+	"venerdì":        "friday",
+	"sabato":         "saturday",
+	"domenica":       "sunday",
+
+	// Spreadsheet
+	"Data":                    "Date",
+	"Orario ingresso":         "Entry time",
+	"Orario uscita teorica":   "Theoretical exit time",
+	"Orario uscita effettiva": "Actual exit time",
+	"Totale":                  "Total",
+	"Straordinario":           "Overtime",
+	"Note":                    "Notes",
+	"Pausa":                   "Break",
+	"Intervalli":              "Intervals",
+	autoExitNote:              "Automatic exit",
+	missingExitNote:           "Missing exit",
+	summarySheetTitle:         "Summary",
+	"Mese":                    "Month",
+	"Giorni lavorati":         "Days worked",
+	"Saldo straordinari":      "Overtime balance",
+	"Ingresso medio":          "Average entry",
+	"Uscita media":            "Average exit",
+
+	// Setup
+	"Ciao %s!": "Hi %s!",
+	"Per iniziare, iniviami la tua posizione, così che possa determinare il tuo fuso orario!": "To get started, send me your location, so that I can work out your time zone!",
+	"Per favore, inviami la tua posizione.":                                                   "Please, send me your location.",
+	"Grazie! Il tuo fuso orario è '%s'.":                                                      "Thanks! Your time zone is '%s'.",
+	"Dove vuoi che registri i tuoi orari lavorativi? Puoi usare un foglio di calcolo sul tuo Google Drive oppure tenerli solo su WorkBot.":                                                   "Where do you want me to record your working hours? You can use a spreadsheet on your Google Drive or keep them only on WorkBot.",
+	"Perfetto, registrerò i tuoi orari lavorativi solo su WorkBot.":                                                                                                                          "Perfect, I will record your working hours only on WorkBot.",
+	"Per registrare i tuoi orari lavorativi, ho bisogno che tu mi dia l'autorizzazione per accedere a Google Sheets. Per favore, apri il link e concedi l'accesso: al termine tornerai qui.": "To record your working hours, I need you to authorize me to access Google Sheets. Please, open the link and grant the access: you will then be brought back here.",
+	"Per registrare i tuoi orari lavorativi, ho bisogno che tu mi dia l'autorizzazione per accedere a Google Sheets.":                                                                        "To record your working hours, I need you to authorize me to access Google Sheets.",
+	"Per favore, visita il link e inviami il codice d'autorizzazione: %s":                                                                                                                    "Please, visit the link and send me the authorization code: %s",
+	"Non è stato possibile ottenere il codice di autorizzazione. Riprova.":                                                                                                                   "The authorization code could not be obtained. Please, try again.",
+	"Autorizzazione avvenuta con successo!":                         "Authorization successful!",
+	"Adesso creo un nuovo foglio di calcolo sul tuo Google Drive.":  "I am now creating a new spreadsheet on your Google Drive.",
+	"Potrebbe volerci qualche secondo...":                           "It may take a few seconds...",
+	"Fatto!":                                                        "Done!",
+	"Troverai i tuoi orari lavorativi registrati all'indirizzo: %s": "You will find your working hours at: %s",
+	"Congratulazioni %s, ora puoi iniziare ad usare Workbot!":       "Congratulations %s, you can now start using Workbot!",
+
+	// Access window
+	"Per ultimo, scegli la fascia oraria in cui entri al lavoro.":                                                                   "Lastly, choose the time window you get to work in.",
+	"Per favore, scegli la fascia oraria in cui entri al lavoro.":                                                                   "Please, choose the time window you get to work in.",
+	"%s Inizia dall'ora con i pulsanti oppure scrivimela, ad esempio 8:00 - 9:30. Se non hai un orario d'ingresso fisso, premi %s.": "%s Start from the hour with the buttons or write it to me, e.g. 8:00 - 9:30. If you have no fixed entry time, press %s.",
+	"Non riesco a capire cosa hai scritto, scrivimi la fascia oraria ad esempio come 8:00 - 9:30.":                                  "I cannot understand what you wrote, write me the time window e.g. as 8:00 - 9:30.",
+	"L'inizio della fascia oraria deve precedere la fine, prova di nuovo.":                                                          "The start of the time window must come before its end, please try again.",
+	"Grazie! Hai scelto la fascia oraria %s.":                                                                                       "Thanks! You chose the time window %s.",
+	"Va bene, non hai una fascia oraria d'ingresso fissa: non ti ricorderò di timbrare l'ingresso né segnalerò i ritardi.":          "All right, you have no fixed entry time window: I will neither remind you to clock in nor report late entries.",
+	"Nessuna fascia oraria d'ingresso fissa.":                                                                                       "No fixed entry time window.",
+	"Inizio della fascia oraria alle %02d: e i minuti?":                                                                             "Time window starting at %02d: and the minutes?",
+	"Inizio della fascia oraria alle %02d:%02d: a che ora finisce?":                                                                 "Time window starting at %02d:%02d: when does it end?",
+	"Fascia oraria dalle %02d:%02d alle %02d: e i minuti?":                                                                          "Time window from %02d:%02d to %02d: and the minutes?",
+	"Fascia oraria dalle %s alle %s.":                                                                                               "Time window from %s to %s.",
+
+	// Main menu and punches
+	"Scegli quale operazione effettuare.":                                                  "Choose what to do.",
+	"Hai già effettuato l'ingresso, quante volte vuoi entrare?! Vai a lavorare!":           "You have already clocked in, how many times do you want to get in?! Get to work!",
+	"Eccoti di nuovo! Ingresso registrato, dopo %s di pausa l'uscita teorica è alle %s.%s": "Welcome back! Entry recorded, after a %s break the theoretical exit is at %s.%s",
+	"Ingresso registrato, l'uscita teorica è alle %s.%s":                                   "Entry recorded, the theoretical exit is at %s.%s",
+	"Oggi non hai ancora effettuato l'ingresso. Devi entrare prima di poter uscire, no?!":  "You have not clocked in yet today. You have to get in before you can get out, right?!",
+	"Hai già effettuato l'uscita, quante volte vuoi uscire?! Per rientrare usa %s.":        "You have already clocked out, how many times do you want to get out?! To get back in use %s.",
+	"Uscita effettuata con successo, oggi hai lavorato %s.%s %s":                           "Clocked out successfully, today you worked %s.%s %s",
+	"A dopo!":       "See you later!",
+	"Buona serata!": "Have a nice evening!",
+	"Sto aggiornando il tuo foglio di calcolo.": "I am updating your spreadsheet.",
+	"Quale timbratura vuoi registrare o correggere? Puoi anche scrivere ad esempio /enter 08:40 oppure /exit ieri 18:05.": "Which punch do you want to record or correct? You can also write e.g. /enter 08:40 or /exit yesterday 18:05.",
+	"%s di %s: a che ora?":          "%s %s: at what time?",
+	"%s di %s alle %s: e i minuti?": "%s %s at %s: and the minutes?",
+	"%s di %s alle %02d:%02d.":      "%s %s at %02d:%02d.",
+	"Operazione annullata.":         "Operation cancelled.",
+	"Non riesco a capire l'orario. Scrivi ad esempio /enter 08:40, /exit ieri 18:05 oppure /enter 15/10 08:40.":          "I cannot understand the time. Write e.g. /enter 08:40, /exit yesterday 18:05 or /enter 15/10 08:40.",
+	"Non posso registrare timbrature nel futuro!":                                                                        "I cannot record punches in the future!",
+	"Ingresso di %s alle %s registrato.%s":                                                                               "Entry %s at %s recorded.%s",
+	"Ingresso corretto: da %s alle %s a %s alle %s.%s":                                                                   "Entry corrected: from %s at %s to %s at %s.%s",
+	"L'ingresso di %s alle %s è già registrato.":                                                                         "The entry %s at %s is already recorded.",
+	"L'ingresso di %s alle %s cade dentro un intervallo già registrato. Correggi prima il suo ingresso o la sua uscita.": "The entry %s at %s falls within an interval already recorded. Correct its entry or its exit first.",
+	"Ingresso di %s alle %s annullato.%s":                                                                                "Entry %s at %s undone.%s",
+	"Correzione annullata: l'ingresso è tornato a %s alle %s.%s":                                                         "Correction undone: the entry is back to %s at %s.%s",
+	"Uscita di %s alle %s registrata.%s":                                                                                 "Exit %s at %s recorded.%s",
+	"Uscita corretta: da %s alle %s a %s alle %s.%s":                                                                     "Exit corrected: from %s at %s to %s at %s.%s",
+	"L'uscita di %s alle %s è già registrata.":                                                                           "The exit %s at %s is already recorded.",
+	"L'uscita di %s alle %s cade dentro un intervallo già registrato. Correggi prima il suo ingresso o la sua uscita.":   "The exit %s at %s falls within an interval already recorded. Correct its entry or its exit first.",
+	"Uscita di %s alle %s annullata.%s":                                                                                  "Exit %s at %s undone.%s",
+	"Correzione annullata: l'uscita è tornata a %s alle %s.%s":                                                           "Correction undone: the exit is back to %s at %s.%s",
+	"Non trovo un ingresso a cui associare l'uscita di %s alle %s. Registra prima l'ingresso.":                           "I cannot find an entry to match the exit %s at %s with. Record the entry first.",
+	"L'uscita di %s alle %s chiuderebbe un intervallo di più di %d ore. Registra prima l'ingresso.":                      "The exit %s at %s would close an interval of more than %d hours. Record the entry first.",
+	"Puoi annullare solo la tua ultima timbratura.":                                                                      "You can only undo your last punch.",
+	"Non c'è nessuna timbratura da annullare.":                                                                           "There is no punch to undo.",
+	"Puoi annullare una timbratura solo entro %d minuti da quando l'hai registrata. Per correggerla usa /enter o /exit seguiti dall'orario giusto.": "You can only undo a punch within %d minutes from when you recorded it. To correct it use /enter or /exit followed by the right time.",
+
+	// Status and reports
+	"Oggi non hai ancora effettuato l'ingresso. Usa %s quando arrivi al lavoro.": "You have not clocked in yet today. Use %s when you get to work.",
+	"📋 Situazione di %s":             "📋 Status %s",
+	"Ingresso: %s":                   "Entry: %s",
+	"Pausa: %s":                      "Break: %s",
+	"Lavorato: %s":                   "Worked: %s",
+	"Mancano: %s":                    "Left: %s",
+	"Uscita teorica: %s":             "Theoretical exit: %s",
+	"Straordinario: %s":              "Overtime: %s",
+	"Sei al lavoro.":                 "You are at work.",
+	"Sei in pausa dalle %s.":         "You have been on a break since %s.",
+	"Uscita effettuata alle %s.":     "Clocked out at %s.",
+	"settimana dal %s al %s":         "week from %s to %s",
+	"📊 Riepilogo: %s":                "📊 Summary: %s",
+	"Nessuna timbratura registrata.": "No punches recorded.",
+	"Giorni lavorati: %d":            "Days worked: %d",
+	"Ore lavorate: %s":               "Hours worked: %s",
+	"Saldo straordinari: %s":         "Overtime balance: %s",
+	"Ingressi in ritardo: %s":        "Late entries: %s",
+	"Uscite mancanti: %s":            "Missing exits: %s",
+	"Registra le uscite mancanti con /exit seguito dal giorno e dall'orario, ad esempio /exit 15/10 18:05.": "Record the missing exits with /exit followed by the day and the time, e.g. /exit 15/10 18:05.",
+
+	// Year-end summary
+	"🎆 Buon anno %s! Da oggi registrerò i tuoi orari lavorativi nel nuovo foglio di calcolo per il %d: %s": "🎆 Happy new year %s! From today I will record your working hours in the new spreadsheet for %d: %s",
+	"Il foglio di calcolo del %d resta all'indirizzo: %s":                                                  "The spreadsheet of %d is still available at: %s",
+
+	// Reminders
+	"Non hai ancora timbrato l'ingresso e sono passate le %s. Sei al lavoro?":                                    "You have not clocked in yet and it is past %s. Are you at work?",
+	"Sono le %s, l'ora della tua uscita teorica: hai lavorato %s. Ricordati di timbrare l'uscita!":               "It is %s, the time of your theoretical exit: you worked %s. Remember to clock out!",
+	"Sei ancora al lavoro? Hai lavorato %s, l'uscita teorica era alle %s. Non dimenticare di timbrare l'uscita!": "Are you still at work? You worked %s, the theoretical exit was at %s. Do not forget to clock out!",
+	"Va bene, te lo ricorderò alle %s.": "All right, I will remind you at %s.",
+	"%s non hai timbrato l'uscita: l'ho registrata io alle %s. Se non è corretta, correggila ad esempio con %s.": "%s you did not clock out: I recorded the exit at %s. If it is not right, correct it e.g. with %s.",
+	"%s non hai timbrato l'uscita e la giornata è rimasta aperta. Registrala ad esempio con %s.":                 "%s you did not clock out and the day was left open. Record the exit e.g. with %s.",
+
+	// Settings
+	"Quali impostazioni vuoi modificare?":                   "Which settings do you want to change?",
+	"Non riesco a capire cosa hai scritto, prova di nuovo.": "I cannot understand what you wrote, please try again.",
+	"Non riesco a capire l'orario, prova di nuovo.":         "I cannot understand the time, please try again.",
+	"Cosa devo fare se dimentichi di timbrare l'uscita? A fine giornata posso lasciarla aperta, chiuderla all'uscita teorica o a un orario fisso, che puoi anche scrivermi (ad esempio 18:30). In ogni caso te lo segnalerò la mattina dopo.": "What should I do if you forget to clock out? At the end of the day I can leave it open, close it at the theoretical exit or at a fixed time, which you can also write to me (e.g. 18:30). In any case I will let you know the next morning.",
+	"Fatto! Se dimentichi l'uscita lascerò la giornata aperta e te lo segnalerò.":                                                       "Done! If you forget to clock out I will leave the day open and let you know.",
+	"Fatto! Se dimentichi l'uscita la registrerò io (%s) e te lo segnalerò.":                                                            "Done! If you forget to clock out I will record the exit myself (%s) and let you know.",
+	"Ogni quanto vuoi ricevere il riepilogo delle tue ore? Lo riceverai alle %d:00 del giorno dopo la fine della settimana o del mese.": "How often do you want to receive the summary of your hours? You will receive it at %d:00 on the day after the end of the week or of the month.",
+	"Non riceverai più il riepilogo automatico. Puoi sempre usare /week e /month.":                                                      "You will no longer receive the automatic summary. You can always use /week and /month.",
+	"Fatto! Riceverai il riepilogo %s.": "Done! You will receive the %s summary.",
+	"Quali festività vuoi rispettare? Nei giorni festivi e nei fine settimana non riceverai promemoria.":                               "Which holidays do you want to observe? You will not receive reminders on holidays and weekends.",
+	"Fatto! Riceverai i promemoria in tutti i giorni feriali.":                                                                         "Done! You will receive the reminders on every weekday.",
+	"Fatto! Non riceverai promemoria nelle festività %s.":                                                                              "Done! You will not receive reminders on the %s holidays.",
+	"Quanto dura la tua giornata lavorativa? Scegli o scrivimi la durata, ad esempio 7:42. Per i giorni con un orario diverso usa %s.": "How long is your work day? Choose or write me its length, e.g. 7:42. For the days with different hours use %s.",
+	"Non riesco a capire la durata, scrivimela ad esempio come 7:42.":                                                                  "I cannot understand the length, write it to me e.g. as 7:42.",
+	"Fatto! La tua giornata lavorativa dura %s.":                                                                                       "Done! Your work day lasts %s.",
+	"Da quanto lavoro in più conta lo straordinario? Scegli o scrivimi la durata, ad esempio 0:20. Con 0:00 conta ogni minuto in più.": "From how much extra work does the overtime count? Choose or write me the length, e.g. 0:20. With 0:00 every extra minute counts.",
+	"Non riesco a capire la durata, scrivimela ad esempio come 0:20.":                                                                  "I cannot understand the length, write it to me e.g. as 0:20.",
+	"Fatto! Lo straordinario conta da %s in più.":                                                                                      "Done! The overtime counts from %s of extra work.",
+	"Ecco il tuo orario settimanale:\n\n%s\n\nPer cambiarlo scrivimi il giorno e la durata, ad esempio «venerdì 6:00» o «sabato %s». Scrivi «venerdì %s» per tornare alla giornata lavorativa di %s.": "Here is your weekly schedule:\n\n%s\n\nTo change it write me the day and the length, e.g. «friday 6:00» or «saturday %s». Write «friday %s» to go back to the work day of %s.",
+	"Non riesco a capire cosa hai scritto. Scrivimi ad esempio «venerdì 6:00», oppure premi %s.":                                                                                                      "I cannot understand what you wrote. Write me e.g. «friday 6:00», or press %s.",
+	"Fatto! Ecco il tuo orario settimanale:":                             "Done! Here is your weekly schedule:",
+	"In che lingua vuoi che ti parli?":                                   "Which language do you want me to speak?",
+	"Fatto! D'ora in poi ti parlerò in italiano.":                        "Done! From now on I will speak English.",
+	"Il tuo foglio di calcolo resta nella lingua in cui è stato creato.": "Your spreadsheet stays in the language it was created in.",
+
+	// Errors
+	"La tua autorizzazione ad accedere a Google Sheets non è più valida. Usa /start per autorizzarmi di nuovo.":                                                                   "Your authorization to access Google Sheets is no longer valid. Use /start to authorize me again.",
+	"Google Sheets è momentaneamente sovraccarico. Riprova tra qualche minuto.":                                                                                                   "Google Sheets is overloaded at the moment. Please, try again in a few minutes.",
+	"Non riesco più a trovare il tuo foglio di calcolo. È stato cancellato?":                                                                                                      "I cannot find your spreadsheet anymore. Has it been deleted?",
+	"Non ho più il permesso di modificare il tuo foglio di calcolo.":                                                                                                              "I am no longer allowed to edit your spreadsheet.",
+	"Google Sheets non risponde. Riprova più tardi.":                                                                                                                              "Google Sheets does not respond. Please, try again later.",
+	"Non hai ancora scelto dove registrare i tuoi orari lavorativi. Usa /start per completare la configurazione.":                                                                 "You have not chosen yet where to record your working hours. Use /start to complete the setup.",
+	"Si è verificato un errore inatteso. Riprova più tardi.":                                                                                                                      "An unexpected error occurred. Please, try again later.",
+	"Non riesco a determinare il tuo fuso orario in questo momento. Riprova più tardi.":                                                                                           "I cannot work out your time zone at the moment. Please, try again later.",
+	"Non ho più accesso al tuo foglio di calcolo su Google Sheets: l'autorizzazione è scaduta o è stata revocata.":                                                                "I can no longer access your spreadsheet on Google Sheets: the authorization expired or was revoked.",
+	"Non sono riuscito ad aggiornare il tuo foglio di calcolo con gli orari di %s. I tuoi orari sono comunque al sicuro: il foglio verrà aggiornato alla prossima registrazione.": "I could not update your spreadsheet with the hours of %s. Your hours are safe anyway: the spreadsheet will be updated at the next punch.",
+	"Torna a WorkBot": "Back to WorkBot",
+	"Il link di autorizzazione non è valido o è scaduto. Torna su Telegram e richiedine uno nuovo.": "The authorization link is not valid or has expired. Go back to Telegram and ask for a new one.",
+	"Non hai concesso l'accesso a Google Sheets. Torna su Telegram per riprovare.":                  "You did not grant the access to Google Sheets. Go back to Telegram to try again.",
+	"Non è stato possibile ottenere l'autorizzazione. Torna su Telegram e riprova.":                 "The authorization could not be obtained. Go back to Telegram and try again.",
+}
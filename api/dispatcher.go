@@ -0,0 +1,88 @@
+package api
+
+import (
+	"sync"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// dispatcher handles the updates of different users concurrently, while
+// the updates of each user are handled one at a time, in order.
+type dispatcher struct {
+	mu      sync.Mutex
+	queues  map[int][]func()
+	workers chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newDispatcher(workers int) *dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &dispatcher{
+		queues:  make(map[int][]func()),
+		workers: make(chan struct{}, workers),
+	}
+}
+
+// dispatch queues u behind the pending updates of the same user.
+func (d *dispatcher) dispatch(u tgbotapi.Update) {
+	d.dispatchFunc(updateUserId(u), func() {
+		handleUpdate(u)
+	})
+}
+
+// dispatchFunc queues f behind the pending updates of the user with the
+// given ID, e.g. to change the user outside of the Telegram updates.
+func (d *dispatcher) dispatchFunc(id int, f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queue, running := d.queues[id]
+	d.queues[id] = append(queue, f)
+	if !running {
+		d.wg.Add(1)
+		go d.run(id)
+	}
+}
+
+// run handles the queued updates of a user until there are none left.
+func (d *dispatcher) run(id int) {
+	defer d.wg.Done()
+
+	for {
+		d.mu.Lock()
+		queue := d.queues[id]
+		if len(queue) == 0 {
+			delete(d.queues, id)
+			d.mu.Unlock()
+			return
+		}
+		f := queue[0]
+		d.queues[id] = queue[1:]
+		d.mu.Unlock()
+
+		d.workers <- struct{}{}
+		f()
+		<-d.workers
+	}
+}
+
+// wait blocks until all the dispatched updates have been handled.
+func (d *dispatcher) wait() {
+	d.wg.Wait()
+}
+
+// updateUserId returns the ID of the user who originated u.
+func updateUserId(u tgbotapi.Update) int {
+	switch {
+	case u.Message != nil && u.Message.From != nil:
+		return u.Message.From.ID
+	case u.EditedMessage != nil && u.EditedMessage.From != nil:
+		return u.EditedMessage.From.ID
+	case u.CallbackQuery != nil && u.CallbackQuery.From != nil:
+		return u.CallbackQuery.From.ID
+	}
+	// Updates that do not come from a user are handled together
+	return 0
+}
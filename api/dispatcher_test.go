@@ -0,0 +1,77 @@
+package api
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherOrder(t *testing.T) {
+	d := newDispatcher(4)
+
+	var mu sync.Mutex
+	handled := make(map[int][]int)
+	running := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		for id := 1; id <= 5; id++ {
+			id, i := id, i
+			d.dispatchFunc(id, func() {
+				mu.Lock()
+				if running[id] {
+					t.Errorf("user %d: update %d handled concurrently with another", id, i)
+				}
+				running[id] = true
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond / 10)
+
+				mu.Lock()
+				running[id] = false
+				handled[id] = append(handled[id], i)
+				mu.Unlock()
+			})
+		}
+	}
+	d.wait()
+
+	for id := 1; id <= 5; id++ {
+		if len(handled[id]) != 50 {
+			t.Errorf("user %d: got %d updates handled, want 50", id, len(handled[id]))
+			continue
+		}
+		for i, got := range handled[id] {
+			if got != i {
+				t.Errorf("user %d: got update %d handled in position %d", id, got, i)
+				break
+			}
+		}
+	}
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+	d := newDispatcher(2)
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	for id := 1; id <= 10; id++ {
+		d.dispatchFunc(id, func() {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+	d.wait()
+
+	if peak > 2 {
+		t.Errorf("got %d updates handled at once, want at most 2", peak)
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lnovara/workbot/types"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// botError is an error that comes with a message explaining it to the
+// user.
+type botError struct {
+	err   error
+	reply string
+}
+
+func (e *botError) Error() string {
+	return e.err.Error()
+}
+
+// telegramError is an error returned by the Telegram Bot API.
+type telegramError struct {
+	err error
+}
+
+func (e *telegramError) Error() string {
+	return e.err.Error()
+}
+
+// isBlocked reports whether Telegram refused a message because the user
+// blocked the bot or deleted their account.
+func (e *telegramError) isBlocked() bool {
+	msg := e.err.Error()
+	return strings.Contains(msg, "bot was blocked by the user") ||
+		strings.Contains(msg, "user is deactivated") ||
+		strings.Contains(msg, "chat not found")
+}
+
+func unexpectedState(user *types.User) error {
+	return fmt.Errorf("api: unexpected state '%d'", user.State)
+}
+
+// friendlyReply returns the message explaining err to the user.
+func friendlyReply(err error) string {
+	if e, ok := err.(*url.Error); ok {
+		// Errors of the OAuth token source are wrapped by the HTTP client
+		err = e.Err
+	}
+
+	switch e := err.(type) {
+	case *botError:
+		return e.reply
+	case *oauth2.RetrieveError:
+		return "La tua autorizzazione ad accedere a Google Sheets non è più valida. Usa /start per autorizzarmi di nuovo."
+	case *googleapi.Error:
+		if isRateLimited(e) {
+			return "Google Sheets è momentaneamente sovraccarico. Riprova tra qualche minuto."
+		} else if e.Code == http.StatusNotFound {
+			return "Non riesco più a trovare il tuo foglio di calcolo. È stato cancellato?"
+		} else if e.Code == http.StatusForbidden {
+			return "Non ho più il permesso di modificare il tuo foglio di calcolo."
+		}
+		return "Google Sheets non risponde. Riprova più tardi."
+	}
+
+	if err == errUnknownBackend {
+		return "Non hai ancora scelto dove registrare i tuoi orari lavorativi. Usa /start per completare la configurazione."
+	}
+
+	return "Si è verificato un errore inatteso. Riprova più tardi."
+}
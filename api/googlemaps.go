@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/lnovara/workbot/types"
 	"googlemaps.github.io/maps"
 )
 
@@ -18,17 +19,19 @@ func NewMapsClient(mapsAPIKey string) error {
 	return err
 }
 
-func timezone(lat float64, lng float64) (string, error) {
+// timezone returns the time zone of a location, whose name Google Maps
+// gives in the given language.
+func timezone(lat float64, lng float64, lang types.Language) (string, error) {
 	r, err := mapsClient.Timezone(context.TODO(), &maps.TimezoneRequest{
 		Location: &maps.LatLng{
 			Lat: lat,
 			Lng: lng,
 		},
 		Timestamp: time.Now(),
-		Language:  "it",
+		Language:  string(lang),
 	})
 	if err != nil {
-		return "", err
+		return "", &botError{err, "Non riesco a determinare il tuo fuso orario in questo momento. Riprova più tardi."}
 	}
 	return r.TimeZoneID, nil
 }
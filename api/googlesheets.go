@@ -2,65 +2,271 @@ package api
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
+	"database/sql"
 	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/goodsign/monday"
 	"github.com/lnovara/workbot/types"
-	"golang.org/x/oauth2"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
 	sheets "google.golang.org/api/sheets/v4"
 )
 
 var (
-	errAlreadyEnter  = errors.New("api: there is already an entry for today")
-	errAlreadyExit   = errors.New("api: there is already an exit for today")
-	errNoEnter       = errors.New("api: there is no entry for today")
-	sheetsClientPool = make(map[int]*sheets.Service)
+	sheetsClientPool = &sheetsClientCache{clients: make(map[int]*sheets.Service)}
+
+	// sheetHeaders are the headers of the columns of the month sheets.
+	sheetHeaders = []string{"Data",
+		"Orario ingresso",
+		"Orario uscita teorica",
+		"Orario uscita effettiva",
+		"Totale",
+		"Straordinario",
+		"Note",
+		"Pausa",
+		"Intervalli"}
 )
 
-func newSheetsClient(user *types.User) error {
-	var err error
-	var token oauth2.Token
-	if sheetsClientPool[user.Id] != nil {
-		// FIXME what if an user tires to authenticate twice? Is it possibile?
+// sheetsClientCache holds the Google Sheets clients of the users, safe for
+// concurrent use.
+type sheetsClientCache struct {
+	mu      sync.Mutex
+	clients map[int]*sheets.Service
+}
+
+// get returns the client of user, creating it if needed.
+func (c *sheetsClientCache) get(user *types.User) (*sheets.Service, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if srv, ok := c.clients[user.Id]; ok {
+		return srv, nil
+	}
+
+	client, err := newOAuthClient(user)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := sheets.New(client)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[user.Id] = srv
+	return srv, nil
+}
+
+// drop removes the client of a user, e.g. because their token changed.
+func (c *sheetsClientCache) drop(userId int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.clients, userId)
+}
+
+// sheetsStore records working hours in a Google Sheets spreadsheet on the
+// user's Google Drive.
+type sheetsStore struct{}
+
+func (sheetsStore) Create(user *types.User, year int) (string, string, error) {
+	return createSpreadsheet(user, year)
+}
+
+func (sheetsStore) Sync(user *types.User, date time.Time, records []types.Record) error {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	spreadsheetId, err := yearTimesheet(user, date.In(loc).Year())
+	if err == errNoTimesheet {
 		return nil
 	}
-	err = json.Unmarshal(user.ClientSecret, &token)
 	if err != nil {
 		return err
 	}
-	sheetsClientPool[user.Id], err = sheets.New(newOAuthClientFromToken(&token))
-	return err
+
+	err = writeMonth(user, spreadsheetId, date, records)
+	if err != nil {
+		return err
+	}
+
+	// The month is written: a failure here leaves the carried balance
+	// stale until the next change, rather than the month to be written
+	// again
+	err = syncCarriedBalance(user, date.In(loc))
+	if err != nil {
+		logrus.Warnf("Could not carry over the overtime balance of %d for user '%d': %s", date.In(loc).Year(), user.Id, err.Error())
+	}
+	return nil
 }
 
-func createSpreadsheet(user *types.User) (string, string, error) {
-	err := newSheetsClient(user)
+func (sheetsStore) Load(user *types.User, date time.Time) ([]types.Record, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	spreadsheetId, err := yearTimesheet(user, date.In(loc).Year())
+	if err == errNoTimesheet {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := getSpreadsheet(user, spreadsheetId, date.In(loc))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []types.Record
+	for _, row := range ms {
+		record := types.Record{}
+		if len(row) > 0 {
+			record.Date = fmt.Sprint(row[0])
+		}
+		day, err := time.ParseInLocation("2006-01-02", record.Date, loc)
+		if err != nil {
+			// Skip rows edited by hand that do not hold a valid date
+			continue
+		}
+		if len(row) > 8 && fmt.Sprint(row[8]) != "" {
+			record.Intervals = parseSheetIntervals(day, fmt.Sprint(row[8]))
+		} else {
+			// Rows written before the intervals were introduced hold a
+			// single one
+			interval := types.Interval{}
+			if len(row) > 1 {
+				interval.Enter = parseSheetTime(day, row[1])
+			}
+			if len(row) > 3 {
+				interval.Exit = parseSheetTime(day, row[3])
+			}
+			record.Intervals = []types.Interval{interval}
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// parseSheetTime parses a time of day as written by formatSheetTime.
+func parseSheetTime(day time.Time, value interface{}) time.Time {
+	s := strings.TrimSpace(fmt.Sprint(value))
+	days := 0
+	if i := strings.Index(s, " (+"); i >= 0 {
+		n, err := strconv.Atoi(strings.TrimSuffix(s[i+3:], ")"))
+		if err != nil {
+			return time.Time{}
+		}
+		s, days = s[:i], n
+	}
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Date(day.Year(), day.Month(), day.Day()+days, t.Hour(), t.Minute(), 0, 0, day.Location())
+}
+
+// formatSheetTime formats the time of day of t, followed by the number of
+// days passed since day if t falls on a later date, e.g. "02:00 (+1)".
+func formatSheetTime(t time.Time, day time.Time) string {
+	s := t.Format("15:04")
+	y1, m1, d1 := day.Date()
+	y2, m2, d2 := t.Date()
+	days := int(time.Date(y2, m2, d2, 0, 0, 0, 0, time.UTC).Sub(time.Date(y1, m1, d1, 0, 0, 0, 0, time.UTC)) / (24 * time.Hour))
+	if days > 0 {
+		s += fmt.Sprintf(" (+%d)", days)
+	}
+	return s
+}
+
+// parseSheetIntervals parses the intervals as written by formatIntervals.
+func parseSheetIntervals(day time.Time, value string) []types.Interval {
+	var intervals []types.Interval
+	for _, s := range strings.Split(value, ",") {
+		times := strings.SplitN(strings.TrimSpace(s), "-", 2)
+		interval := types.Interval{Enter: parseSheetTime(day, times[0])}
+		if len(times) > 1 && strings.TrimSpace(times[1]) != "" {
+			interval.Exit = parseSheetTime(day, times[1])
+		}
+		intervals = append(intervals, interval)
+	}
+	return intervals
+}
+
+// formatIntervals formats the intervals of a day as "08:30-12:30,
+// 13:30-17:12". The exit of an open interval is left empty.
+func formatIntervals(day time.Time, intervals []types.Interval) string {
+	var s []string
+	for _, i := range intervals {
+		exit := ""
+		if i.HasExit() {
+			exit = formatSheetTime(i.Exit, day)
+		}
+		s = append(s, formatSheetTime(i.Enter, day)+"-"+exit)
 	}
+	return strings.Join(s, ", ")
+}
+
+// formatDuration formats d as a Google Sheets duration.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second)
+}
 
-	srv := sheetsClientPool[user.Id]
+// overtimeFormula returns the formula computing the overtime of day from
+// its total, according to schedule, written in the given row of its month
+// sheet. The row is referenced explicitly: the implicit intersection of a
+// whole column breaks when the rows move or the sheet is exported.
+func overtimeFormula(schedule *types.WorkSchedule, day time.Time, row int) string {
+	return fmt.Sprintf("=IF(E%[3]d - \"%[1]s\" > TIMEVALUE(\"%[2]s\"), E%[3]d - \"%[1]s\", IF(E%[3]d - \"%[1]s\" < 0, E%[3]d - \"%[1]s\", 0))",
+		formatClock(schedule.WorkDuration(day)),
+		schedule.ExtraWorkStart.Format("15:04:05"),
+		row)
+}
+
+// monthSheetTitle returns the title of the sheet of the month date belongs
+// to, in the language of the spreadsheet of user, e.g. "Ottobre".
+func monthSheetTitle(user *types.User, date time.Time) string {
+	return strings.Title(monday.Format(date, "January", mondayLocale(user.SheetLanguage)))
+}
+
+func createSpreadsheet(user *types.User, year int) (string, string, error) {
+	srv, err := sheetsClientPool.get(user)
+	if err != nil {
+		return "", "", err
+	}
 
 	ctx := context.Background()
 
+	// The sheets of the months come first, in order, then the summary
 	var monthSheets []*sheets.Sheet
-	for i := 0; i < 12; i++ {
-		month := monday.Format(time.Date(2000, time.Month(i+1), 1, 0, 0, 0, 0, time.UTC), "January", monday.LocaleItIT)
+	for month := 1; month <= 12; month++ {
 		monthSheets = append(monthSheets, &sheets.Sheet{
 			Properties: &sheets.SheetProperties{
-				Title: strings.Title(month),
+				Title: sheetTitle(user, month),
 			},
 		})
 	}
+	monthSheets = append(monthSheets, &sheets.Sheet{
+		Properties: &sheets.SheetProperties{
+			Title: sheetTitle(user, summaryMonth),
+		},
+	})
 
 	rb := &sheets.Spreadsheet{
 		Properties: &sheets.SpreadsheetProperties{
 			Locale:   "en_US",
 			TimeZone: user.TimeZone,
-			Title:    fmt.Sprintf("WorkBot %d", time.Now().Year()),
+			Title:    fmt.Sprintf("WorkBot %d", year),
 		},
 		Sheets: monthSheets,
 	}
@@ -70,8 +276,49 @@ func createSpreadsheet(user *types.User) (string, string, error) {
 		return "", "", err
 	}
 
-	var r []*sheets.Request
+	var sheetIds []int64
 	for i := range resp.Sheets {
+		sheetIds = append(sheetIds, resp.Sheets[i].Properties.SheetId)
+	}
+	err = setUpMonthSheets(srv, user, resp.SpreadsheetId, sheetIds[:12])
+	if err != nil {
+		return "", "", err
+	}
+	err = setUpSummarySheet(srv, resp.SpreadsheetId, sheetIds[12])
+	if err != nil {
+		return "", "", err
+	}
+
+	for i, id := range sheetIds {
+		month := i + 1
+		if month > 12 {
+			month = summaryMonth
+		}
+		err = userdb.SaveMonthSheet(&types.MonthSheet{UserId: user.Id, SpreadsheetId: resp.SpreadsheetId, Month: month, SheetId: id})
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	err = writeSummarySheet(srv, user, resp.SpreadsheetId, year)
+	if err != nil {
+		return "", "", err
+	}
+	err = autoResizeColumns(srv, resp.SpreadsheetId)
+	if err != nil {
+		return "", "", err
+	}
+
+	return resp.SpreadsheetId, resp.SpreadsheetUrl, nil
+}
+
+// setUpMonthSheets formats the sheets with the given IDs as month sheets and
+// writes their headers.
+func setUpMonthSheets(srv *sheets.Service, user *types.User, spreadsheetId string, sheetIds []int64) error {
+	ctx := context.Background()
+
+	var r []*sheets.Request
+	for _, id := range sheetIds {
 		r = append(r, &sheets.Request{
 			RepeatCell: &sheets.RepeatCellRequest{
 				Cell: &sheets.CellData{
@@ -83,9 +330,10 @@ func createSpreadsheet(user *types.User) (string, string, error) {
 				},
 				Fields: "userEnteredFormat.textFormat",
 				Range: &sheets.GridRange{
-					SheetId:       resp.Sheets[i].Properties.SheetId,
-					StartRowIndex: 0,
-					EndRowIndex:   1,
+					SheetId:         id,
+					StartRowIndex:   0,
+					EndRowIndex:     1,
+					ForceSendFields: []string{"SheetId"},
 				},
 			},
 		})
@@ -101,10 +349,11 @@ func createSpreadsheet(user *types.User) (string, string, error) {
 				},
 				Fields: "userEnteredFormat.numberFormat",
 				Range: &sheets.GridRange{
-					SheetId:          resp.Sheets[i].Properties.SheetId,
+					SheetId:          id,
 					StartRowIndex:    1,
 					StartColumnIndex: 0,
 					EndColumnIndex:   1,
+					ForceSendFields:  []string{"SheetId"},
 				},
 			},
 		})
@@ -120,10 +369,11 @@ func createSpreadsheet(user *types.User) (string, string, error) {
 				},
 				Fields: "userEnteredFormat.numberFormat",
 				Range: &sheets.GridRange{
-					SheetId:          resp.Sheets[i].Properties.SheetId,
+					SheetId:          id,
 					StartRowIndex:    1,
 					StartColumnIndex: 1,
 					EndColumnIndex:   4,
+					ForceSendFields:  []string{"SheetId"},
 				},
 			},
 		})
@@ -139,10 +389,31 @@ func createSpreadsheet(user *types.User) (string, string, error) {
 				},
 				Fields: "userEnteredFormat.numberFormat",
 				Range: &sheets.GridRange{
-					SheetId:          resp.Sheets[i].Properties.SheetId,
+					SheetId:          id,
 					StartRowIndex:    1,
 					StartColumnIndex: 4,
 					EndColumnIndex:   6,
+					ForceSendFields:  []string{"SheetId"},
+				},
+			},
+		})
+		r = append(r, &sheets.Request{
+			RepeatCell: &sheets.RepeatCellRequest{
+				Cell: &sheets.CellData{
+					UserEnteredFormat: &sheets.CellFormat{
+						NumberFormat: &sheets.NumberFormat{
+							Type:    "TIME",
+							Pattern: "[h]:mm:ss",
+						},
+					},
+				},
+				Fields: "userEnteredFormat.numberFormat",
+				Range: &sheets.GridRange{
+					SheetId:          id,
+					StartRowIndex:    1,
+					StartColumnIndex: 7,
+					EndColumnIndex:   8,
+					ForceSendFields:  []string{"SheetId"},
 				},
 			},
 		})
@@ -153,7 +424,8 @@ func createSpreadsheet(user *types.User) (string, string, error) {
 					GridProperties: &sheets.GridProperties{
 						FrozenRowCount: 1,
 					},
-					SheetId: resp.Sheets[i].Properties.SheetId,
+					SheetId:         id,
+					ForceSendFields: []string{"SheetId"},
 				},
 			},
 		})
@@ -163,148 +435,246 @@ func createSpreadsheet(user *types.User) (string, string, error) {
 		Requests: r,
 	}
 
-	_, err = srv.Spreadsheets.BatchUpdate(resp.SpreadsheetId, busr).Context(ctx).Do()
+	_, err := srv.Spreadsheets.BatchUpdate(spreadsheetId, busr).Context(ctx).Do()
 	if err != nil {
-		return "", "", err
-	}
-
-	vr := &sheets.ValueRange{
-		Values: [][]interface{}{{"Data",
-			"Orario ingresso",
-			"Orario uscita teorica",
-			"Orario uscita effettiva",
-			"Totale",
-			"Straordinario",
-			"Note"}},
+		return err
 	}
 
-	for i := range resp.Sheets {
-		wr := fmt.Sprintf("%s!A1", resp.Sheets[i].Properties.Title)
-		_, err = srv.Spreadsheets.Values.Update(resp.SpreadsheetId, wr, vr).ValueInputOption("USER_ENTERED").Do()
-		if err != nil {
-			return "", "", err
-		}
+	var headers []interface{}
+	for _, h := range sheetHeaders {
+		headers = append(headers, translate(user.SheetLanguage, h))
 	}
-
-	r = nil
-	for i := range resp.Sheets {
-		r = append(r, &sheets.Request{
-			AutoResizeDimensions: &sheets.AutoResizeDimensionsRequest{
-				Dimensions: &sheets.DimensionRange{
-					Dimension:  "COLUMNS",
-					SheetId:    resp.Sheets[i].Properties.SheetId,
-					StartIndex: 0,
-				},
-			},
+	var data []*sheets.DataFilterValueRange
+	for _, id := range sheetIds {
+		data = append(data, &sheets.DataFilterValueRange{
+			DataFilter: sheetRange(id, 0, 1, 0),
+			Values:     [][]interface{}{headers},
 		})
 	}
 
-	busr = &sheets.BatchUpdateSpreadsheetRequest{
-		Requests: r,
+	vr := &sheets.BatchUpdateValuesByDataFilterRequest{
+		Data:             data,
+		ValueInputOption: "USER_ENTERED",
 	}
+	_, err = srv.Spreadsheets.Values.BatchUpdateByDataFilter(spreadsheetId, vr).Context(ctx).Do()
+	return err
+}
 
-	_, err = srv.Spreadsheets.BatchUpdate(resp.SpreadsheetId, busr).Context(ctx).Do()
-	if err != nil {
-		return "", "", err
+// sheetRange returns the data filter matching the rows of the sheet with the
+// given ID from the start one to the end one, excluded, or to the last one
+// if end is zero, from the given column to the last one of the headers.
+// Rows and columns are counted from zero.
+func sheetRange(sheetId int64, start, end, column int64) *sheets.DataFilter {
+	return &sheets.DataFilter{
+		GridRange: &sheets.GridRange{
+			SheetId:          sheetId,
+			StartRowIndex:    start,
+			EndRowIndex:      end,
+			StartColumnIndex: column,
+			EndColumnIndex:   int64(len(sheetHeaders)),
+			ForceSendFields:  []string{"SheetId"},
+		},
 	}
-
-	return resp.SpreadsheetId, resp.SpreadsheetUrl, nil
 }
 
-func getSpreadsheet(user *types.User, month string) ([][]interface{}, error) {
-	err := newSheetsClient(user)
-	if err != nil {
-		return nil, err
+// monthSheetId returns the ID of the sheet of the month date belongs to in
+// the given spreadsheet of user, looking for the sheets if their IDs are
+// not known yet.
+func monthSheetId(srv *sheets.Service, user *types.User, spreadsheetId string, date time.Time) (int64, error) {
+	sheet, err := userdb.GetMonthSheet(user.Id, spreadsheetId, int(date.Month()))
+	if err == sql.ErrNoRows {
+		err = repairMonthSheets(srv, user, spreadsheetId, date.Year())
+		if err != nil {
+			return 0, err
+		}
+		sheet, err = userdb.GetMonthSheet(user.Id, spreadsheetId, int(date.Month()))
 	}
-
-	srv := sheetsClientPool[user.Id]
-
-	readRange := fmt.Sprintf("%s!A2:G", month)
-	resp, err := srv.Spreadsheets.Values.Get(user.SheetId, readRange).Do()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-
-	return resp.Values, nil
+	return sheet.SheetId, nil
 }
 
-func appendEnterTime(user *types.User, date time.Time) error {
-	err := newSheetsClient(user)
+// withMonthSheet calls f with the ID of the sheet of the month date belongs
+// to. If the request is rejected, e.g. because the sheet has been deleted,
+// the sheets are repaired and f is called once more.
+func withMonthSheet(srv *sheets.Service, user *types.User, spreadsheetId string, date time.Time, f func(sheetId int64) error) error {
+	id, err := monthSheetId(srv, user, spreadsheetId, date)
 	if err != nil {
 		return err
 	}
+	err = f(id)
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusBadRequest {
+		return err
+	}
 
-	srv := sheetsClientPool[user.Id]
-
-	loc, err := time.LoadLocation(user.TimeZone)
+	logrus.Infof("Repairing the month sheets in spreadsheet '%s' of user '%d' after a rejected request: %s", spreadsheetId, user.Id, err.Error())
+	err = repairMonthSheets(srv, user, spreadsheetId, date.Year())
 	if err != nil {
 		return err
 	}
-
-	ms, err := getSpreadsheet(user, monday.Format(date.In(loc), "January", monday.LocaleItIT))
+	id, err = monthSheetId(srv, user, spreadsheetId, date)
 	if err != nil {
 		return err
 	}
+	return f(id)
+}
 
-	if len(ms) > 0 {
-		lastRow := ms[len(ms)-1]
-		if lastRow[0] == date.In(loc).Format("2006-01-02") {
-			return errAlreadyEnter
-		}
+// repairMonthSheets finds again the sheets of the months and the summary
+// sheet in the given spreadsheet of user for year. A known sheet is kept as long as
+// it exists, whatever its title and position; the others are looked up by
+// their title, in any language, and are created if they have been deleted
+// or, like the summary of the older spreadsheets, never existed.
+func repairMonthSheets(srv *sheets.Service, user *types.User, spreadsheetId string, year int) error {
+	spreadsheet, err := srv.Spreadsheets.Get(spreadsheetId).Fields("sheets.properties").Do()
+	if err != nil {
+		return err
 	}
 
-	vr := &sheets.ValueRange{
-		Values: [][]interface{}{{date.In(loc).Format("2006-01-02"),
-			date.In(loc).Format("15:04"),
-			fmt.Sprintf("=B:B + \"%s\"", user.WorkDay.Format("15:04")),
-			"",
-			"=D:D - B:B",
-			fmt.Sprintf("=IF(E:E - \"%[1]s\" > TIMEVALUE(\"%[2]s\"), E:E - \"%[1]s\", IF(E:E - \"%[1]s\" < 0, E:E - \"%[1]s\", 0))",
-				user.WorkDay.Format("15:04"),
-				user.ExtraWorkStart.Format("15:04:05")),
-		}},
+	titles := make(map[string]int64)
+	exists := make(map[int64]bool)
+	for _, s := range spreadsheet.Sheets {
+		titles[strings.ToLower(strings.TrimSpace(s.Properties.Title))] = s.Properties.SheetId
+		exists[s.Properties.SheetId] = true
 	}
 
-	appendRange := fmt.Sprintf("%s!A:A", strings.Title(monday.Format(date.In(loc), "January", monday.LocaleItIT)))
-	_, err = srv.Spreadsheets.Values.Append(user.SheetId, appendRange, vr).ValueInputOption("USER_ENTERED").Do()
-	if err != nil {
-		return err
+	// The sheets still holding a month cannot be claimed by another one
+	claimed := make(map[int64]bool)
+	var lost []int
+	for month := summaryMonth; month <= 12; month++ {
+		sheet, err := userdb.GetMonthSheet(user.Id, spreadsheetId, month)
+		if err == nil && exists[sheet.SheetId] {
+			claimed[sheet.SheetId] = true
+			continue
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		lost = append(lost, month)
 	}
 
-	spreadsheet, err := srv.Spreadsheets.Get(user.SheetId).Do()
-	if err != nil {
-		return err
+	var missing []int
+	for _, month := range lost {
+		id, ok := int64(0), false
+		for _, title := range sheetTitles(month) {
+			if id, ok = titles[title]; ok && !claimed[id] {
+				break
+			}
+			ok = false
+		}
+		if !ok {
+			missing = append(missing, month)
+			continue
+		}
+		claimed[id] = true
+		err = userdb.SaveMonthSheet(&types.MonthSheet{UserId: user.Id, SpreadsheetId: spreadsheetId, Month: month, SheetId: id})
+		if err != nil {
+			return err
+		}
+	}
+	if len(missing) == 0 {
+		return nil
 	}
 
 	var r []*sheets.Request
-	for i := range spreadsheet.Sheets {
+	for _, month := range missing {
 		r = append(r, &sheets.Request{
-			AutoResizeDimensions: &sheets.AutoResizeDimensionsRequest{
-				Dimensions: &sheets.DimensionRange{
-					Dimension:  "COLUMNS",
-					SheetId:    spreadsheet.Sheets[i].Properties.SheetId,
-					StartIndex: 0,
+			AddSheet: &sheets.AddSheetRequest{
+				Properties: &sheets.SheetProperties{
+					Title: sheetTitle(user, month),
 				},
 			},
 		})
 	}
-
-	busr := &sheets.BatchUpdateSpreadsheetRequest{
-		Requests: r,
+	resp, err := srv.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{Requests: r}).Do()
+	if err != nil {
+		return err
 	}
 
-	ctx := context.Background()
+	var monthIds []int64
+	for i, month := range missing {
+		id := resp.Replies[i].AddSheet.Properties.SheetId
+		if month == summaryMonth {
+			err = setUpSummarySheet(srv, spreadsheetId, id)
+			if err != nil {
+				return err
+			}
+		} else {
+			monthIds = append(monthIds, id)
+		}
+		err = userdb.SaveMonthSheet(&types.MonthSheet{UserId: user.Id, SpreadsheetId: spreadsheetId, Month: month, SheetId: id})
+		if err != nil {
+			return err
+		}
+	}
+	if len(monthIds) > 0 {
+		err = setUpMonthSheets(srv, user, spreadsheetId, monthIds)
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Created %d sheets in spreadsheet '%s' of user '%d'", len(missing), spreadsheetId, user.Id)
 
-	_, err = srv.Spreadsheets.BatchUpdate(user.SheetId, busr).Context(ctx).Do()
+	// The formulas of the summary referencing the deleted sheets are broken
+	err = writeSummarySheet(srv, user, spreadsheetId, year)
 	if err != nil {
 		return err
 	}
+	return autoResizeColumns(srv, spreadsheetId)
+}
 
+// RepairTimesheet finds again the sheets of the months and the summary
+// sheets in the spreadsheets of user, after they have been renamed, moved
+// or deleted.
+func RepairTimesheet(user *types.User) error {
+	if user.Backend != types.GoogleSheets {
+		return nil
+	}
+	srv, err := sheetsClientPool.get(user)
+	if err != nil {
+		return err
+	}
+	timesheets, err := userdb.GetTimesheets(user.Id)
+	if err != nil {
+		return err
+	}
+	for _, t := range timesheets {
+		err = repairMonthSheets(srv, user, t.SheetId, t.Year)
+		if err != nil {
+			return fmt.Errorf("could not repair the timesheet of %d: %s", t.Year, err.Error())
+		}
+	}
 	return nil
 }
 
-func appendExitTime(user *types.User, date time.Time) error {
-	err := newSheetsClient(user)
+// getSpreadsheet returns the rows of the sheet of the month date belongs to
+// in the given spreadsheet, without the headers.
+func getSpreadsheet(user *types.User, spreadsheetId string, date time.Time) ([][]interface{}, error) {
+	srv, err := sheetsClientPool.get(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var values [][]interface{}
+	err = withMonthSheet(srv, user, spreadsheetId, date, func(sheetId int64) error {
+		req := &sheets.BatchGetValuesByDataFilterRequest{
+			DataFilters: []*sheets.DataFilter{sheetRange(sheetId, 1, 0, 0)},
+		}
+		resp, err := srv.Spreadsheets.Values.BatchGetByDataFilter(spreadsheetId, req).Do()
+		if err != nil {
+			return err
+		}
+		values = nil
+		if len(resp.ValueRanges) > 0 && resp.ValueRanges[0].ValueRange != nil {
+			values = resp.ValueRanges[0].ValueRange.Values
+		}
+		return nil
+	})
+	return values, err
+}
+
+func writeMonth(user *types.User, spreadsheetId string, date time.Time, records []types.Record) error {
+	srv, err := sheetsClientPool.get(user)
 	if err != nil {
 		return err
 	}
@@ -314,40 +684,94 @@ func appendExitTime(user *types.User, date time.Time) error {
 		return err
 	}
 
-	srv := sheetsClientPool[user.Id]
-
-	month := monday.Format(date.In(loc), "January", monday.LocaleItIT)
-	ms, err := getSpreadsheet(user, month)
+	schedules, err := loadScheduleHistory(user)
 	if err != nil {
 		return err
 	}
 
-	if len(ms) > 0 {
-		lastRow := ms[len(ms)-1]
-		if lastRow[0] != date.In(loc).Format("2006-01-02") {
-			return errNoEnter
+	var values [][]interface{}
+	for i, r := range records {
+		day, err := time.ParseInLocation("2006-01-02", r.Date, loc)
+		if err != nil {
+			return err
+		}
+		// Each day is written with the settings in effect on it
+		schedule := schedules.at(day)
+		// Durations and times are computed here rather than by formulas,
+		// which cannot tell the date of a time of day: night shifts and DST
+		// changes would be miscounted.
+		exit := ""
+		if r.HasExit() {
+			exit = formatSheetTime(r.Exit(), day)
+		}
+		var pause interface{}
+		if r.Break() > 0 {
+			pause = formatDuration(r.Break())
 		}
-		if lastRow[3] != "" {
-			return errAlreadyExit
+		var note interface{}
+		if r.AutoExit() {
+			note = translate(user.SheetLanguage, autoExitNote)
+		} else if isForgotten(user, &r, time.Now()) {
+			note = translate(user.SheetLanguage, missingExitNote)
 		}
-	} else {
-		return errNoEnter
+		values = append(values, []interface{}{r.Date,
+			formatSheetTime(r.Enter(), day),
+			formatSheetTime(r.TheoreticalExit(schedule.WorkDuration(day)), day),
+			exit,
+			formatDuration(r.Worked()),
+			overtimeFormula(schedule, day, i+2),
+			note,
+			pause,
+			formatIntervals(day, r.Intervals),
+		})
 	}
-
-	vr := &sheets.ValueRange{
-		Values: [][]interface{}{{
-			date.In(loc).Format("15:04"),
-		}},
+	if len(values) > 0 {
+		// Not holding a date, the totals are skipped when the month is
+		// loaded and by the summary
+		last := len(values) + 1
+		values = append(values, []interface{}{translate(user.SheetLanguage, "Totale"),
+			nil,
+			nil,
+			nil,
+			fmt.Sprintf("=SUM(E2:E%d)", last),
+			fmt.Sprintf("=SUM(F2:F%d)", last),
+		})
 	}
 
-	updateRange := fmt.Sprintf("%s!D%d", month, len(ms)+1)
-	_, err = srv.Spreadsheets.Values.Update(user.SheetId, updateRange, vr).ValueInputOption("USER_ENTERED").Do()
-	if err != nil {
+	err = withMonthSheet(srv, user, spreadsheetId, date.In(loc), func(sheetId int64) error {
+		cr := &sheets.BatchClearValuesByDataFilterRequest{
+			DataFilters: []*sheets.DataFilter{sheetRange(sheetId, 1, 0, 0)},
+		}
+		_, err := srv.Spreadsheets.Values.BatchClearByDataFilter(spreadsheetId, cr).Do()
+		if err != nil || len(values) == 0 {
+			return err
+		}
+
+		// The spreadsheets created before the intervals were introduced lack
+		// the headers of the last columns
+		header := &sheets.DataFilterValueRange{
+			DataFilter: sheetRange(sheetId, 0, 1, 7),
+			Values:     [][]interface{}{{translate(user.SheetLanguage, sheetHeaders[7]), translate(user.SheetLanguage, sheetHeaders[8])}},
+		}
+		busr := &sheets.BatchUpdateValuesByDataFilterRequest{
+			Data: []*sheets.DataFilterValueRange{header, {
+				DataFilter: sheetRange(sheetId, 1, 0, 0),
+				Values:     values,
+			}},
+			ValueInputOption: "USER_ENTERED",
+		}
+		_, err = srv.Spreadsheets.Values.BatchUpdateByDataFilter(spreadsheetId, busr).Do()
+		return err
+	})
+	if err != nil || len(values) == 0 {
 		return err
 	}
 
-	// FIXME: refactor autoresizerequest in separate func
-	spreadsheet, err := srv.Spreadsheets.Get(user.SheetId).Do()
+	return autoResizeColumns(srv, spreadsheetId)
+}
+
+func autoResizeColumns(srv *sheets.Service, spreadsheetId string) error {
+	spreadsheet, err := srv.Spreadsheets.Get(spreadsheetId).Do()
 	if err != nil {
 		return err
 	}
@@ -371,10 +795,6 @@ func appendExitTime(user *types.User, date time.Time) error {
 
 	ctx := context.Background()
 
-	_, err = srv.Spreadsheets.BatchUpdate(user.SheetId, busr).Context(ctx).Do()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	_, err = srv.Spreadsheets.BatchUpdate(spreadsheetId, busr).Context(ctx).Do()
+	return err
 }
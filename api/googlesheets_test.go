@@ -0,0 +1,71 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+func TestSheetTime(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Rome")
+	day := time.Date(2026, time.October, 24, 0, 0, 0, 0, loc)
+
+	tests := []struct {
+		t time.Time
+		s string
+	}{
+		{time.Date(2026, time.October, 24, 8, 30, 0, 0, loc), "08:30"},
+		{time.Date(2026, time.October, 24, 23, 59, 0, 0, loc), "23:59"},
+		// The night shift across the change to the standard time
+		{time.Date(2026, time.October, 25, 6, 0, 0, 0, loc), "06:00 (+1)"},
+		{time.Date(2026, time.October, 26, 0, 0, 0, 0, loc), "00:00 (+2)"},
+	}
+	for _, tt := range tests {
+		if got := formatSheetTime(tt.t, day); got != tt.s {
+			t.Errorf("format %s: got %q, want %q", tt.t, got, tt.s)
+		}
+		if got := parseSheetTime(day, tt.s); !got.Equal(tt.t) {
+			t.Errorf("parse %q: got %s, want %s", tt.s, got, tt.t)
+		}
+	}
+
+	// Cells that are not times are read as empty
+	for _, s := range []interface{}{"", "ferie", "06:00 (+x)", 42} {
+		if got := parseSheetTime(day, s); !got.IsZero() {
+			t.Errorf("parse %v: got %s, want zero time", s, got)
+		}
+	}
+}
+
+func TestSheetIntervals(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Rome")
+	day := time.Date(2026, time.October, 14, 0, 0, 0, 0, loc)
+	at := func(d, h, m int) time.Time {
+		return time.Date(2026, time.October, d, h, m, 0, 0, loc)
+	}
+
+	tests := []struct {
+		intervals []types.Interval
+		s         string
+	}{
+		{[]types.Interval{{Enter: at(14, 8, 30), Exit: at(14, 12, 30)}, {Enter: at(14, 13, 30), Exit: at(14, 17, 12)}}, "08:30-12:30, 13:30-17:12"},
+		{[]types.Interval{{Enter: at(14, 22, 0), Exit: at(15, 6, 0)}}, "22:00-06:00 (+1)"},
+		{[]types.Interval{{Enter: at(14, 8, 30), Exit: at(14, 12, 30)}, {Enter: at(14, 13, 30)}}, "08:30-12:30, 13:30-"},
+	}
+	for _, tt := range tests {
+		if got := formatIntervals(day, tt.intervals); got != tt.s {
+			t.Errorf("format: got %q, want %q", got, tt.s)
+		}
+		got := parseSheetIntervals(day, tt.s)
+		if len(got) != len(tt.intervals) {
+			t.Errorf("parse %q: got %d intervals, want %d", tt.s, len(got), len(tt.intervals))
+			continue
+		}
+		for i := range got {
+			if !got[i].Enter.Equal(tt.intervals[i].Enter) || !got[i].Exit.Equal(tt.intervals[i].Exit) {
+				t.Errorf("parse %q: got %v, want %v", tt.s, got[i], tt.intervals[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+const (
+	changeHolidaysFormat = changeHolidays + " (%s)"
+	changeHolidays       = "🎉 Festività"
+)
+
+// holidaysNames are the names of the holiday calendars, as adjectives of
+// "festività".
+var holidaysNames = map[types.Holidays]string{
+	types.NoHolidays:      "nessuna",
+	types.ItalianHolidays: "italiane",
+}
+
+// italianHolidays are the Italian national holidays, as month and day.
+var italianHolidays = []struct {
+	month time.Month
+	day   int
+}{
+	{time.January, 1},   // Capodanno
+	{time.January, 6},   // Epifania
+	{time.April, 25},    // Festa della Liberazione
+	{time.May, 1},       // Festa del Lavoro
+	{time.June, 2},      // Festa della Repubblica
+	{time.August, 15},   // Ferragosto
+	{time.November, 1},  // Ognissanti
+	{time.December, 8},  // Immacolata Concezione
+	{time.December, 25}, // Natale
+	{time.December, 26}, // Santo Stefano
+}
+
+// isWorkingDay reports whether date is neither a weekend day nor a
+// holiday of the calendar of user.
+func isWorkingDay(user *types.User, date time.Time) bool {
+	if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		return false
+	}
+	return user.Holidays != types.ItalianHolidays || !isItalianHoliday(date)
+}
+
+// isItalianHoliday reports whether date is an Italian national holiday.
+func isItalianHoliday(date time.Time) bool {
+	y, m, d := date.Date()
+	for _, h := range italianHolidays {
+		if h.month == m && h.day == d {
+			return true
+		}
+	}
+
+	// Lunedì dell'Angelo
+	monday := easter(y).AddDate(0, 0, 1)
+	return m == monday.Month() && d == monday.Day()
+}
+
+// easter returns the date of Easter in the given year, with the anonymous
+// Gregorian algorithm.
+func easter(year int) time.Time {
+	a := year % 19
+	b := year / 100
+	c := year % 100
+	d := b / 4
+	e := b % 4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i := c / 4
+	k := c % 4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+// holidaysName returns the name of the holiday calendar of user in their
+// language.
+func holidaysName(user *types.User) string {
+	return tr(user, holidaysNames[user.Holidays])
+}
+
+func handleSetHolidays(user *types.User, msg *tgbotapi.Message) error {
+	if msg == nil {
+		kb := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(strings.Title(tr(user, holidaysNames[types.ItalianHolidays]))),
+				tgbotapi.NewKeyboardButton(strings.Title(tr(user, holidaysNames[types.NoHolidays]))),
+			),
+		)
+		kb.OneTimeKeyboard = true
+		mc := createReply(user, "Quali festività vuoi rispettare? Nei giorni festivi e nei fine settimana non riceverai promemoria.")
+		mc.ReplyMarkup = kb
+		return send(mc)
+	}
+
+	holidays, ok := types.NoHolidays, false
+	for h, name := range holidaysNames {
+		if text := strings.TrimSpace(msg.Text); strings.EqualFold(text, name) || strings.EqualFold(text, tr(user, name)) {
+			holidays, ok = h, true
+		}
+	}
+	if !ok {
+		return reply(user, "Non riesco a capire cosa hai scritto, prova di nuovo.")
+	}
+
+	user.Holidays = holidays
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	if holidays == types.NoHolidays {
+		err = reply(user, "Fatto! Riceverai i promemoria in tutti i giorni feriali.")
+	} else {
+		err = reply(user, "Fatto! Non riceverai promemoria nelle festività %s.", holidaysName(user))
+	}
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+func TestEaster(t *testing.T) {
+	tests := []struct {
+		year int
+		want string
+	}{
+		{1961, "1961-04-02"},
+		{2000, "2000-04-23"},
+		{2008, "2008-03-23"},
+		{2011, "2011-04-24"},
+		{2019, "2019-04-21"},
+		{2024, "2024-03-31"},
+		{2025, "2025-04-20"},
+		{2026, "2026-04-05"},
+		{2038, "2038-04-25"},
+		{2285, "2285-03-22"},
+	}
+	for _, tt := range tests {
+		if got := easter(tt.year).Format("2006-01-02"); got != tt.want {
+			t.Errorf("%d: got %s, want %s", tt.year, got, tt.want)
+		}
+	}
+}
+
+func TestIsWorkingDay(t *testing.T) {
+	tests := []struct {
+		holidays types.Holidays
+		date     string
+		want     bool
+	}{
+		{types.ItalianHolidays, "2026-10-14", true},
+		{types.ItalianHolidays, "2026-10-17", false},
+		{types.ItalianHolidays, "2026-10-18", false},
+		{types.ItalianHolidays, "2026-12-08", false},
+		{types.ItalianHolidays, "2026-04-06", false},
+		{types.ItalianHolidays, "2025-04-21", false},
+		{types.ItalianHolidays, "2025-04-22", true},
+		{types.NoHolidays, "2026-12-08", true},
+		{types.NoHolidays, "2026-04-06", true},
+		{types.NoHolidays, "2026-10-17", false},
+	}
+	for _, tt := range tests {
+		user := &types.User{Holidays: tt.holidays}
+		date, _ := time.Parse("2006-01-02", tt.date)
+		if got := isWorkingDay(user, date); got != tt.want {
+			t.Errorf("%s with holidays %q: got %t, want %t", tt.date, tt.holidays, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/goodsign/monday"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+// The messages are written in Italian, which also identifies them in the
+// catalogs of the other languages. A message missing from a catalog is sent
+// in Italian.
+
+const (
+	changeLanguageFormat = changeLanguage + " (%s)"
+	changeLanguage       = "🌐 Lingua"
+)
+
+var (
+	// languages lists the available languages in the order they are
+	// offered.
+	languages = []types.Language{types.Italian, types.English}
+
+	languageNames = map[types.Language]string{
+		types.Italian: "🇮🇹 Italiano",
+		types.English: "🇬🇧 English",
+	}
+
+	catalogs = map[types.Language]map[string]string{
+		types.English: englishCatalog,
+	}
+
+	mondayLocales = map[types.Language]monday.Locale{
+		types.Italian: monday.LocaleItIT,
+		types.English: monday.LocaleEnUS,
+	}
+)
+
+// translate returns msg in the given language.
+func translate(lang types.Language, msg string) string {
+	if t, ok := catalogs[lang][msg]; ok {
+		return t
+	}
+	return msg
+}
+
+// tr returns msg in the language of user.
+func tr(user *types.User, msg string) string {
+	return translate(user.Language, msg)
+}
+
+// trf formats data according to format, in the language of user.
+func trf(user *types.User, format string, data ...interface{}) string {
+	return fmt.Sprintf(tr(user, format), data...)
+}
+
+// detectLanguage returns the language matching the IETF language tag of a
+// Telegram user, e.g. "en-US". Users speaking any other language get
+// English.
+func detectLanguage(code string) types.Language {
+	base := strings.ToLower(strings.TrimSpace(code))
+	if i := strings.IndexAny(base, "-_;"); i >= 0 {
+		base = base[:i]
+	}
+	if base == "" {
+		return types.Italian
+	}
+	for _, lang := range languages {
+		if string(lang) == base {
+			return lang
+		}
+	}
+	return types.English
+}
+
+// mondayLocale returns the locale the dates are formatted with in the given
+// language.
+func mondayLocale(lang types.Language) monday.Locale {
+	if locale, ok := mondayLocales[lang]; ok {
+		return locale
+	}
+	return monday.LocaleItIT
+}
+
+// isButton reports whether text is the label of a button, either in the
+// language of user or in Italian, as sent by a keyboard shown before the
+// language changed.
+func isButton(user *types.User, text string, label string) bool {
+	return text == label || text == tr(user, label)
+}
+
+// hasButtonPrefix is like isButton for the buttons showing a setting after
+// their label.
+func hasButtonPrefix(user *types.User, text string, label string) bool {
+	return strings.HasPrefix(text, label) || strings.HasPrefix(text, tr(user, label))
+}
+
+func handleSetLanguage(user *types.User, msg *tgbotapi.Message) error {
+	if msg == nil {
+		row := tgbotapi.NewKeyboardButtonRow()
+		for _, lang := range languages {
+			row = append(row, tgbotapi.NewKeyboardButton(languageNames[lang]))
+		}
+		kb := tgbotapi.NewReplyKeyboard(row)
+		kb.OneTimeKeyboard = true
+		mc := createReply(user, "In che lingua vuoi che ti parli?")
+		mc.ReplyMarkup = kb
+		return send(mc)
+	}
+
+	lang, ok := types.Language(""), false
+	for l, name := range languageNames {
+		if strings.TrimSpace(msg.Text) == name {
+			lang, ok = l, true
+		}
+	}
+	if !ok {
+		return reply(user, "Non riesco a capire cosa hai scritto, prova di nuovo.")
+	}
+
+	user.Language = lang
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	text := tr(user, "Fatto! D'ora in poi ti parlerò in italiano.")
+	if user.Backend == types.GoogleSheets && user.SheetLanguage != user.Language {
+		text += " " + tr(user, "Il tuo foglio di calcolo resta nella lingua in cui è stato creato.")
+	}
+	err = reply(user, "%s", text)
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
@@ -0,0 +1,539 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errAlreadyEnter = errors.New("api: the user is already at work")
+	errAlreadyExit  = errors.New("api: the user is not at work")
+	errNoEnter      = errors.New("api: there is no entry for today")
+	errFuturePunch  = errors.New("api: the punch is in the future")
+	errPunchExists  = errors.New("api: there is already the same punch at that time")
+	errLongInterval = errors.New("api: the interval would be too long")
+	errOverlap      = errors.New("api: the punch falls within a closed interval")
+	errNoUndo       = errors.New("api: there is no punch to undo")
+	errUndoExpired  = errors.New("api: the punch is too old to be undone")
+)
+
+// UndoWindow is how long after being recorded a punch can be undone.
+var UndoWindow = 15 * time.Minute
+
+// maxIntervalLength is the longest interval an exit can close, e.g. a night
+// shift. Older open intervals are considered forgotten.
+const maxIntervalLength = 24 * time.Hour
+
+// registerEnter records in the ledger that user entered at date, opening
+// a new interval of the day. It returns the recorded event and the updated
+// record of the day.
+func registerEnter(user *types.User, date time.Time) (*types.Event, *types.Record, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = importMonth(user, date)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	open, err := openRecord(user, date)
+	if err != nil {
+		return nil, nil, err
+	}
+	if open != nil {
+		return nil, nil, errAlreadyEnter
+	}
+
+	records, err := monthRecords(user, date)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	event := types.NewEvent(user.Id, types.EnterEvent, date)
+	err = userdb.AppendEvent(event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	record := findRecord(records, date.In(loc).Format("2006-01-02"))
+	if record == nil {
+		record = &types.Record{Date: date.In(loc).Format("2006-01-02")}
+	}
+	record.Intervals = append(record.Intervals, types.Interval{Enter: date.In(loc)})
+	return event, record, nil
+}
+
+// registerExit records in the ledger that user exited at date, closing the
+// open interval. The exit belongs to the day the interval was opened, e.g.
+// the day before for a night shift. It returns the recorded event and the
+// updated record of that day.
+func registerExit(user *types.User, date time.Time) (*types.Event, *types.Record, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = importMonth(user, date)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	record, err := openRecord(user, date)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record == nil {
+		last, err := userdb.GetLastEvent(user.Id, date)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+		if err == nil && last.Kind == types.ExitEvent && date.Sub(last.Time) <= maxIntervalLength {
+			return nil, nil, errAlreadyExit
+		}
+		return nil, nil, errNoEnter
+	}
+
+	event := types.NewEvent(user.Id, types.ExitEvent, date)
+	err = userdb.AppendEvent(event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	record.Intervals[len(record.Intervals)-1].Exit = date.In(loc)
+	return event, record, nil
+}
+
+// openRecord returns the record of the day holding the interval open at
+// date, if any.
+func openRecord(user *types.User, date time.Time) (*types.Record, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := userdb.GetLastEvent(user.Id, date)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if last.Kind != types.EnterEvent || date.Sub(last.Time) > maxIntervalLength {
+		return nil, nil
+	}
+
+	records, err := monthRecords(user, last.Time)
+	if err != nil {
+		return nil, err
+	}
+	record := findRecord(records, last.Time.In(loc).Format("2006-01-02"))
+	if record != nil && isForgotten(user, record, date) {
+		// The day is over, the user can start a new one
+		return nil, nil
+	}
+	return record, nil
+}
+
+// registerPunch records in the ledger a punch of the given kind made by
+// recordedBy at an explicit date, e.g. a forgotten one. The punch corrects
+// the adjacent one of the same kind, if any, or is added if it keeps the
+// entries and exits alternated. It returns the recorded event and the
+// corrected one, if any.
+func registerPunch(user *types.User, kind types.EventKind, date time.Time, recordedBy int) (*types.Event, *types.Event, error) {
+	if date.After(time.Now()) {
+		return nil, nil, errFuturePunch
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = importMonth(user, date)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prev, err := userdb.GetLastEvent(user.Id, date)
+	if err == sql.ErrNoRows {
+		prev = nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	next, err := userdb.GetNextEvent(user.Id, date)
+	if err == sql.ErrNoRows {
+		next = nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if prev != nil && prev.Kind == kind && prev.Time.Equal(date) {
+		return nil, nil, errPunchExists
+	}
+
+	// Moving an adjacent punch of the same kind keeps the order of the
+	// ledger: the entry of an interval can move within it, and so can its
+	// exit. Punches of other days are never moved.
+	day := date.In(loc).Format("2006-01-02")
+	adjacent := func(e *types.Event) bool {
+		return e != nil && e.Kind == kind && e.Time.In(loc).Format("2006-01-02") == day
+	}
+
+	var replaced *types.Event
+	switch {
+	case adjacent(prev):
+		replaced = prev
+	case adjacent(next):
+		replaced = next
+	case next != nil && next.Kind == types.ExitEvent && prev != nil && prev.Kind == types.EnterEvent:
+		// A new punch between the entry and the exit of an interval
+		// would split it, leaving either half unmatched
+		return nil, nil, errOverlap
+	case kind == types.ExitEvent:
+		if prev == nil || prev.Kind != types.EnterEvent {
+			return nil, nil, errNoEnter
+		}
+		if date.Sub(prev.Time) > maxIntervalLength {
+			return nil, nil, errLongInterval
+		}
+	}
+
+	event := types.NewEvent(user.Id, kind, date)
+	event.RecordedBy = recordedBy
+	if replaced != nil {
+		event.Replaces = replaced.Id
+	}
+	err = userdb.AppendEvent(event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return event, replaced, nil
+}
+
+// undoPunch reverts the last punch recorded for user, if it was recorded
+// at most UndoWindow ago. If id is not zero, the last punch must be the one
+// with that ID. The reversal is appended to the ledger: a corrected punch
+// gets its previous time back, any other is voided. It returns the reverted
+// event and the restored one, if any.
+func undoPunch(user *types.User, id int64) (*types.Event, *types.Event, error) {
+	last, err := userdb.GetLastRecordedEvent(user.Id)
+	if err == sql.ErrNoRows {
+		return nil, nil, errNoUndo
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// The exits closing the forgotten days are corrected, not undone, and
+	// the imported punches were never made in the bot
+	if id != 0 && last.Id != id || last.RecordedBy == types.WorkBot || last.RecordedBy == types.Imported {
+		return nil, nil, errNoUndo
+	}
+	if time.Since(last.RecordedAt) > UndoWindow {
+		return nil, nil, errUndoExpired
+	}
+
+	var restored *types.Event
+	revert := types.NewEvent(user.Id, types.VoidEvent, last.Time)
+	if last.Replaces != 0 {
+		restored, err = userdb.GetEvent(last.Replaces)
+		if err != nil {
+			return nil, nil, err
+		}
+		revert = types.NewEvent(user.Id, restored.Kind, restored.Time)
+	}
+	revert.Replaces = last.Id
+
+	err = userdb.AppendEvent(revert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return last, restored, nil
+}
+
+// findRecord returns the record of the given day, if any.
+func findRecord(records []types.Record, day string) *types.Record {
+	for i := range records {
+		if records[i].Date == day {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+// overtime returns the difference between worked and the work day of
+// schedule on the day of date. As in the timesheet, a surplus counts only
+// when it exceeds ExtraWorkStart, while a shortfall always counts.
+func overtime(schedule *types.WorkSchedule, date time.Time, worked time.Duration) time.Duration {
+	diff := worked - schedule.WorkDuration(date)
+	if diff > clockDuration(schedule.ExtraWorkStart) || diff < 0 {
+		return diff
+	}
+	return 0
+}
+
+func clockDuration(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+}
+
+// currentRecord returns the record of the day user is working on at now:
+// the one holding the open interval, e.g. a night shift started yesterday,
+// or else the one of today, if any.
+func currentRecord(user *types.User, now time.Time) (*types.Record, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	err = importMonth(user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := openRecord(user, now)
+	if record != nil || err != nil {
+		return record, err
+	}
+
+	records, err := monthRecords(user, now)
+	if err != nil {
+		return nil, err
+	}
+	return findRecord(records, now.In(loc).Format("2006-01-02")), nil
+}
+
+// monthBounds returns the first instant of the month date belongs to and
+// the first instant of the following one, in the user's time zone.
+func monthBounds(user *types.User, date time.Time) (time.Time, time.Time, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	first := time.Date(date.In(loc).Year(), date.In(loc).Month(), 1, 0, 0, 0, 0, loc)
+	return first, first.AddDate(0, 1, 0), nil
+}
+
+// monthRecords replays the ledger to compute the records of the month date
+// belongs to.
+func monthRecords(user *types.User, date time.Time) ([]types.Record, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to, err := monthBounds(user, date)
+	if err != nil {
+		return nil, err
+	}
+
+	// Include the exits closing the intervals opened on the last day
+	events, err := userdb.GetEvents(user.Id, from, to.Add(maxIntervalLength))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []types.Record
+	for _, e := range events {
+		if e.Kind == types.EnterEvent && !e.Time.Before(to) {
+			break
+		}
+
+		switch e.Kind {
+		case types.EnterEvent:
+			day := e.Time.In(loc).Format("2006-01-02")
+			if len(records) == 0 || records[len(records)-1].Date != day {
+				records = append(records, types.Record{Date: day})
+			}
+			r := &records[len(records)-1]
+			r.Intervals = append(r.Intervals, types.Interval{Enter: e.Time.In(loc)})
+		case types.ExitEvent:
+			// Exits closing an interval of the previous month are skipped
+			if len(records) > 0 && !records[len(records)-1].HasExit() {
+				r := &records[len(records)-1]
+				r.Intervals[len(r.Intervals)-1].Exit = e.Time.In(loc)
+				r.Intervals[len(r.Intervals)-1].AutoExit = e.RecordedBy == types.WorkBot
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// importMonth fills the ledger with the records held by the user's
+// timesheet for the month date belongs to, if the ledger has none. This
+// preserves the working hours registered before the ledger existed.
+func importMonth(user *types.User, date time.Time) error {
+	from, to, err := monthBounds(user, date)
+	if err != nil {
+		return err
+	}
+
+	if !user.LedgerStart.IsZero() && to.After(user.LedgerStart) {
+		// The ledger is authoritative for this month
+		return nil
+	}
+
+	count, err := userdb.CountEvents(user.Id, from, to)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	store, err := timesheetStore(user)
+	if err != nil {
+		return err
+	}
+
+	records, err := store.Load(user, date)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		for _, i := range r.Intervals {
+			if i.Enter.IsZero() {
+				continue
+			}
+			err = appendImportedEvent(user, types.EnterEvent, i.Enter)
+			if err != nil {
+				return err
+			}
+			if i.HasExit() {
+				err = appendImportedEvent(user, types.ExitEvent, i.Exit)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(records) > 0 {
+		logrus.Infof("Imported %d records of %s for user '%d' into the ledger", len(records), from.Format("2006-01"), user.Id)
+	}
+
+	if user.LedgerStart.IsZero() && !from.After(time.Now()) && to.After(time.Now()) {
+		user.LedgerStart = from
+		return userdb.UpdateUser(user)
+	}
+
+	return nil
+}
+
+// appendImportedEvent appends to the ledger the event of the given kind at
+// t, imported from the timesheet of user.
+func appendImportedEvent(user *types.User, kind types.EventKind, t time.Time) error {
+	event := types.NewEvent(user.Id, kind, t)
+	event.RecordedBy = types.Imported
+	return userdb.AppendEvent(event)
+}
+
+// syncMonth rewrites the user's timesheet for the month date belongs to
+// from the ledger.
+func syncMonth(user *types.User, date time.Time) error {
+	store, err := timesheetStore(user)
+	if err != nil {
+		return err
+	}
+
+	records, err := monthRecords(user, date)
+	if err != nil {
+		return err
+	}
+
+	return store.Sync(user, date, records)
+}
+
+// RebuildTimesheet creates a new timesheet for user and fills it with the
+// current year's records kept in the ledger. It returns the URL of the new
+// timesheet, if any.
+func RebuildTimesheet(user *types.User) (string, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().In(loc)
+	var months []time.Time
+	for i := 0; i < 12; i++ {
+		months = append(months, time.Date(now.Year(), time.Month(i+1), 1, 0, 0, 0, 0, loc))
+	}
+
+	// User.SheetId is the timesheet of the next year in its last day:
+	// import from the timesheet of the current year, if any, and never
+	// create one just to read it
+	_, err = userdb.GetTimesheet(user.Id, now.Year())
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if err == nil {
+		for _, m := range months {
+			err = importMonth(user, m)
+			if err != nil {
+				logrus.Warnf("Could not import %s for user '%d' from the old timesheet: %s", m.Format("2006-01"), user.Id, err.Error())
+			}
+		}
+	}
+
+	_, sheetUrl, err := createTimesheet(user, now.Year())
+	if err != nil {
+		return "", err
+	}
+
+	for _, m := range months {
+		err = syncMonth(user, m)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return sheetUrl, nil
+}
+
+// RewriteTimesheet writes again from the ledger the months of the timesheets
+// of user up to the current one, e.g. to bring the older ones to the current
+// layout, and adds the sheets they lack, such as the summary. The months
+// that predate the ledger are imported first.
+func RewriteTimesheet(user *types.User) error {
+	if user.Backend != types.GoogleSheets {
+		return nil
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	err = RepairTimesheet(user)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+
+	timesheets, err := userdb.GetTimesheets(user.Id)
+	if err != nil {
+		return err
+	}
+	for _, t := range timesheets {
+		for m := time.Date(t.Year, time.January, 1, 0, 0, 0, 0, loc); m.Year() == t.Year && !m.After(now); m = m.AddDate(0, 1, 0) {
+			err = importMonth(user, m)
+			if err != nil {
+				return err
+			}
+			err = syncMonth(user, m)
+			if err != nil {
+				return fmt.Errorf("could not rewrite %s: %s", m.Format("2006-01"), err.Error())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+// openTestDB opens an empty database in memory, migrated to the latest
+// schema.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	_, err := userdb.NewUserDB(":memory:")
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+}
+
+// newTestUser returns a user whose ledger is authoritative for every month,
+// so that no timesheet is imported.
+func newTestUser() *types.User {
+	return &types.User{
+		Id:          1,
+		TimeZone:    "Europe/Rome",
+		LedgerStart: time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// appendTestEvents appends to the ledger of user the punches of the given
+// kinds at the given times, in the time zone of user.
+func appendTestEvents(t *testing.T, user *types.User, punches ...interface{}) {
+	t.Helper()
+	loc, _ := time.LoadLocation(user.TimeZone)
+	for i := 0; i < len(punches); i += 2 {
+		date, _ := time.ParseInLocation("2006-01-02 15:04", punches[i+1].(string), loc)
+		err := userdb.AppendEvent(types.NewEvent(user.Id, punches[i].(types.EventKind), date))
+		if err != nil {
+			t.Fatalf("could not append the event: %s", err)
+		}
+	}
+}
+
+func TestRegisterPunch(t *testing.T) {
+	// A night shift, then a day off
+	shift := []interface{}{
+		types.EnterEvent, "2026-10-05 22:00",
+		types.ExitEvent, "2026-10-06 06:00",
+	}
+
+	tests := []struct {
+		name     string
+		kind     types.EventKind
+		date     string
+		err      error
+		replaced string
+	}{
+		{"enter after the shift", types.EnterEvent, "2026-10-07 08:00", nil, ""},
+		{"enter moved within the shift", types.EnterEvent, "2026-10-05 23:00", nil, "2026-10-05 22:00"},
+		{"exit moved within the shift", types.ExitEvent, "2026-10-06 05:00", nil, "2026-10-06 06:00"},
+		{"exit moved after the shift", types.ExitEvent, "2026-10-06 07:00", nil, "2026-10-06 06:00"},
+		{"enter inside the shift", types.EnterEvent, "2026-10-06 05:00", errOverlap, ""},
+		{"exit inside the shift", types.ExitEvent, "2026-10-05 23:00", errOverlap, ""},
+		{"exit without an enter", types.ExitEvent, "2026-10-07 12:00", errNoEnter, ""},
+		{"same punch", types.ExitEvent, "2026-10-06 06:00", errPunchExists, ""},
+		{"future punch", types.EnterEvent, "2100-01-01 08:00", errFuturePunch, ""},
+	}
+	for _, tt := range tests {
+		openTestDB(t)
+		user := newTestUser()
+		appendTestEvents(t, user, shift...)
+
+		loc, _ := time.LoadLocation(user.TimeZone)
+		date, _ := time.ParseInLocation("2006-01-02 15:04", tt.date, loc)
+		event, replaced, err := registerPunch(user, tt.kind, date, user.Id)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !event.Time.Equal(date) || event.Kind != tt.kind {
+			t.Errorf("%s: got %v at %s", tt.name, event.Kind, event.Time)
+		}
+		got := ""
+		if replaced != nil {
+			got = replaced.Time.In(loc).Format("2006-01-02 15:04")
+		}
+		if got != tt.replaced {
+			t.Errorf("%s: replaced %q, want %q", tt.name, got, tt.replaced)
+		}
+	}
+}
+
+func TestMonthRecords(t *testing.T) {
+	openTestDB(t)
+	user := newTestUser()
+	appendTestEvents(t, user,
+		// The night shift across the months is left to September
+		types.EnterEvent, "2026-09-30 22:00",
+		types.ExitEvent, "2026-10-01 06:00",
+		types.EnterEvent, "2026-10-01 08:30",
+		types.ExitEvent, "2026-10-01 12:30",
+		types.EnterEvent, "2026-10-01 13:30",
+		types.ExitEvent, "2026-10-01 17:12",
+		types.EnterEvent, "2026-10-02 08:30",
+		// The night shift across the months is left to October
+		types.EnterEvent, "2026-10-31 22:00",
+		types.ExitEvent, "2026-11-01 06:00",
+		types.EnterEvent, "2026-11-01 08:00",
+	)
+	// The forgotten exit of the 2nd, closed by WorkBot
+	loc, _ := time.LoadLocation(user.TimeZone)
+	exit, _ := time.ParseInLocation("2006-01-02 15:04", "2026-10-02 18:00", loc)
+	auto := types.NewEvent(user.Id, types.ExitEvent, exit)
+	auto.RecordedBy = types.WorkBot
+	if err := userdb.AppendEvent(auto); err != nil {
+		t.Fatalf("could not append the event: %s", err)
+	}
+
+	records, err := monthRecords(user, exit)
+	if err != nil {
+		t.Fatalf("could not compute the records: %s", err)
+	}
+
+	want := []struct {
+		date      string
+		intervals string
+		autoExit  bool
+	}{
+		{"2026-10-01", "08:30-12:30, 13:30-17:12", false},
+		{"2026-10-02", "08:30-18:00", true},
+		{"2026-10-31", "22:00-06:00 (+1)", false},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for i, w := range want {
+		r := records[i]
+		day, _ := time.ParseInLocation("2006-01-02", r.Date, loc)
+		got := formatIntervals(day, r.Intervals)
+		if r.Date != w.date || got != w.intervals {
+			t.Errorf("record %d: got %s %q, want %s %q", i, r.Date, got, w.date, w.intervals)
+		}
+		last := r.Intervals[len(r.Intervals)-1]
+		if last.AutoExit != w.autoExit {
+			t.Errorf("record %s: got automatic exit %t, want %t", r.Date, last.AutoExit, w.autoExit)
+		}
+	}
+}
+
+func TestUndoPunch(t *testing.T) {
+	openTestDB(t)
+	user := newTestUser()
+	appendTestEvents(t, user,
+		types.EnterEvent, "2026-10-14 08:30",
+		types.ExitEvent, "2026-10-14 17:00",
+	)
+	loc, _ := time.LoadLocation(user.TimeZone)
+	at := func(s string) time.Time {
+		date, _ := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		return date
+	}
+	day := func() string {
+		records, err := monthRecords(user, at("2026-10-14 00:00"))
+		if err != nil {
+			t.Fatalf("could not compute the records: %s", err)
+		}
+		var days []string
+		for _, r := range records {
+			date, _ := time.ParseInLocation("2006-01-02", r.Date, loc)
+			days = append(days, formatIntervals(date, r.Intervals))
+		}
+		return strings.Join(days, "; ")
+	}
+
+	// A correction gets the previous time back
+	_, _, err := registerPunch(user, types.ExitEvent, at("2026-10-14 18:00"), user.Id)
+	if err != nil {
+		t.Fatalf("could not register the punch: %s", err)
+	}
+	undone, restored, err := undoPunch(user, 0)
+	if err != nil || !undone.Time.Equal(at("2026-10-14 18:00")) || restored == nil || !restored.Time.Equal(at("2026-10-14 17:00")) {
+		t.Fatalf("undo of a correction: got %v, %v, %v", undone, restored, err)
+	}
+	if got := day(); got != "08:30-17:00" {
+		t.Errorf("after the undo of a correction: got %q", got)
+	}
+
+	// A new punch is voided, and only the last one can be undone
+	event, _, err := registerPunch(user, types.EnterEvent, at("2026-10-15 08:00"), user.Id)
+	if err != nil {
+		t.Fatalf("could not register the punch: %s", err)
+	}
+	if _, _, err := undoPunch(user, event.Id+1); err != errNoUndo {
+		t.Errorf("undo of another punch: got %v, want %v", err, errNoUndo)
+	}
+	undone, restored, err = undoPunch(user, event.Id)
+	if err != nil || undone.Id != event.Id || restored != nil {
+		t.Fatalf("undo of a new punch: got %v, %v, %v", undone, restored, err)
+	}
+	if got := day(); got != "08:30-17:00" {
+		t.Errorf("after the undo of a new punch: got %q", got)
+	}
+
+	// The punches recorded too long ago are kept
+	_, _, err = registerPunch(user, types.EnterEvent, at("2026-10-15 08:00"), user.Id)
+	if err != nil {
+		t.Fatalf("could not register the punch: %s", err)
+	}
+	window := UndoWindow
+	UndoWindow = 0
+	defer func() { UndoWindow = window }()
+	if _, _, err := undoPunch(user, 0); err != errUndoExpired {
+		t.Errorf("undo of an old punch: got %v, want %v", err, errUndoExpired)
+	}
+}
+
+// fakeStore is a timesheet backend holding fixed records.
+type fakeStore struct {
+	records []types.Record
+}
+
+func (s fakeStore) Create(user *types.User, year int) (string, string, error) {
+	return "", "", nil
+}
+
+func (s fakeStore) Load(user *types.User, date time.Time) ([]types.Record, error) {
+	return s.records, nil
+}
+
+func (s fakeStore) Sync(user *types.User, date time.Time, records []types.Record) error {
+	return nil
+}
+
+func TestUndoImportedPunch(t *testing.T) {
+	openTestDB(t)
+	user := newTestUser()
+	user.Backend = types.Backend("fake")
+	user.LedgerStart = time.Time{}
+	loc, _ := time.LoadLocation(user.TimeZone)
+	timesheetStores[user.Backend] = fakeStore{records: []types.Record{{
+		Date:      "2020-01-14",
+		Intervals: []types.Interval{{Enter: time.Date(2020, time.January, 14, 8, 30, 0, 0, loc), Exit: time.Date(2020, time.January, 14, 17, 0, 0, 0, loc)}},
+	}}}
+	defer delete(timesheetStores, user.Backend)
+
+	err := importMonth(user, time.Date(2020, time.January, 14, 0, 0, 0, 0, loc))
+	if err != nil {
+		t.Fatalf("could not import the month: %s", err)
+	}
+	if _, err := userdb.GetLastRecordedEvent(user.Id); err != nil {
+		t.Fatalf("got no imported punch: %s", err)
+	}
+	if _, _, err := undoPunch(user, 0); err != errNoUndo {
+		t.Errorf("undo of an imported punch: got %v, want %v", err, errNoUndo)
+	}
+}
+
+func TestYearTimesheet(t *testing.T) {
+	openTestDB(t)
+	user := newTestUser()
+	user.Backend = types.GoogleSheets
+	err := userdb.InsertUser(user)
+	if err != nil {
+		t.Fatalf("could not insert the user: %s", err)
+	}
+
+	// On the last day of 2026 the timesheet of 2027 is already the current
+	// one
+	for _, ts := range []types.Timesheet{{UserId: user.Id, Year: 2026, SheetId: "sheet-2026"}, {UserId: user.Id, Year: 2027, SheetId: "sheet-2027"}} {
+		err = userdb.SaveTimesheet(&ts)
+		if err != nil {
+			t.Fatalf("could not save the timesheet: %s", err)
+		}
+	}
+	user.SheetId = "sheet-2027"
+
+	tests := []struct {
+		year int
+		want string
+		err  error
+	}{
+		{2026, "sheet-2026", nil},
+		{2027, "sheet-2027", nil},
+		{2025, "", errNoTimesheet},
+	}
+	for _, tt := range tests {
+		got, err := yearTimesheet(user, tt.year)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%d: got %q, %v, want %q, %v", tt.year, got, err, tt.want, tt.err)
+		}
+	}
+}
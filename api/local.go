@@ -0,0 +1,22 @@
+package api
+
+import (
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+// localStore keeps the working hours only in the attendance ledger.
+type localStore struct{}
+
+func (localStore) Create(user *types.User, year int) (string, string, error) {
+	return "", "", nil
+}
+
+func (localStore) Load(user *types.User, date time.Time) ([]types.Record, error) {
+	return nil, nil
+}
+
+func (localStore) Sync(user *types.User, date time.Time, records []types.Record) error {
+	return nil
+}
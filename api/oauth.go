@@ -2,9 +2,17 @@ package api
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -12,38 +20,170 @@ import (
 )
 
 var (
+	errNotAuthorized = errors.New("api: user has not authorized access to Google Sheets")
+	errTokenRevoked  = errors.New("api: Google OAuth token has been revoked")
+
 	oAuthConfig *oauth2.Config
 )
 
-// NewOAuthConfig initialize a new OAuth config
-func NewOAuthConfig(clientSecretPath string) {
+// NewOAuthConfig initialize a new OAuth config. If callback has a redirect
+// URL, the authorization codes are received by the OAuth callback.
+func NewOAuthConfig(clientSecretPath string, callback OAuthCallbackConfig) error {
 	cs, err := ioutil.ReadFile(clientSecretPath)
 	if err != nil {
-		logrus.Fatalf("Could not read Google client secrets from %s: %s", clientSecretPath, err.Error())
+		return err
 	}
 
 	oAuthConfig, err = google.ConfigFromJSON(cs, sheets.SpreadsheetsScope)
 	if err != nil {
-		logrus.Fatalf("Could not initialize Google OAuth2 Client: %s", err.Error())
+		return err
+	}
+
+	if callback.RedirectURL != "" {
+		oAuthConfig.RedirectURL = callback.RedirectURL
+		oAuthStateKey = make([]byte, 32)
+		_, err = rand.Read(oAuthStateKey)
+		if err != nil {
+			return err
+		}
+	}
+	oAuthCallback = callback
+	return nil
+}
+
+// getToken exchanges the authorization code for a token, sending the PKCE
+// code verifier if not empty.
+func getToken(authCode string, verifier string) (*oauth2.Token, error) {
+	return oAuthConfig.Exchange(exchangeContext(verifier), authCode)
+}
+
+// newOAuthClient returns an HTTP client authorized with the user's token.
+// Refreshed tokens are saved back to the user database.
+func newOAuthClient(user *types.User) (*http.Client, error) {
+	if len(user.ClientSecret) == 0 {
+		return nil, errNotAuthorized
+	}
+
+	var token oauth2.Token
+	err := json.Unmarshal(user.ClientSecret, &token)
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		// The access token would expire without a way to refresh it, nor
+		// the refresh would fail with invalid_grant: authorize again
+		return nil, errNotAuthorized
+	}
+
+	ctx := context.Background()
+	src := &persistentTokenSource{
+		userId: user.Id,
+		src:    oAuthConfig.TokenSource(ctx, &token),
+		saved:  token.AccessToken,
 	}
+	return oauth2.NewClient(ctx, src), nil
 }
 
-func getToken(authCode string) (*oauth2.Token, error) {
-	return oAuthConfig.Exchange(context.TODO(), authCode)
+// persistentTokenSource is a TokenSource that saves the tokens refreshed
+// by src to the user database, and detects the revoked ones.
+type persistentTokenSource struct {
+	userId int
+	src    oauth2.TokenSource
+
+	mu    sync.Mutex // guards saved
+	saved string
 }
 
-func newOAuthClientFromAuthCode(authCode string) *http.Client {
-	token, err := getToken(authCode)
+func (s *persistentTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.src.Token()
 	if err != nil {
-		logrus.Fatalf("Could not get OAuth token: %s", err.Error())
+		if isInvalidGrant(err) {
+			logrus.Warnf("Google OAuth token of user '%d' has been revoked", s.userId)
+			sheetsClientPool.drop(s.userId)
+			err = userdb.UpdateClientSecret(s.userId, nil)
+			if err != nil {
+				logrus.Errorf("Could not clear the client secret of user '%d': %s", s.userId, err.Error())
+			}
+			return nil, errTokenRevoked
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token.AccessToken != s.saved {
+		clientSecret, err := json.Marshal(token)
+		if err == nil {
+			err = userdb.UpdateClientSecret(s.userId, clientSecret)
+		}
+		if err != nil {
+			// The token is valid anyway: it will be saved at the next refresh
+			logrus.Errorf("Could not save the refreshed token of user '%d': %s", s.userId, err.Error())
+		} else {
+			s.saved = token.AccessToken
+		}
 	}
-	return oAuthConfig.Client(context.Background(), token)
+
+	return token, nil
+}
+
+// isInvalidGrant reports whether err is the response of the token endpoint
+// to a refresh token that has expired or has been revoked.
+func isInvalidGrant(err error) bool {
+	e, ok := err.(*oauth2.RetrieveError)
+	if !ok {
+		return false
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(e.Body, &body) == nil {
+		return body.Error == "invalid_grant"
+	}
+	return strings.Contains(string(e.Body), "invalid_grant")
+}
+
+// needsAuthorization reports whether err means that the user has to
+// authorize the access to Google Sheets again.
+func needsAuthorization(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		// Errors of the token source are wrapped by the HTTP client
+		err = e.Err
+	}
+	return err == errNotAuthorized || err == errTokenRevoked
 }
 
-func newOAuthClientFromToken(token *oauth2.Token) *http.Client {
-	return oAuthConfig.Client(context.Background(), token)
+// reauthorize moves the user back into the authorization flow.
+func reauthorize(user *types.User) error {
+	user.State = types.UserSetupClientSecret
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+	err = reply(user, "Non ho più accesso al tuo foglio di calcolo su Google Sheets: l'autorizzazione è scaduta o è stata revocata.")
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
 }
 
-func authCodeURL() string {
-	return oAuthConfig.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+// authCodeURL returns the link the user authorizes the access to Google
+// Sheets at. With the OAuth callback, the link carries a state identifying
+// the user and a PKCE code challenge. The consent is always asked: Google
+// returns a refresh token only along with it, e.g. not to the users who
+// authorize the access again.
+func authCodeURL(user *types.User) (string, error) {
+	if oAuthCallback.RedirectURL == "" {
+		return oAuthConfig.AuthCodeURL("", oauth2.AccessTypeOffline, oauth2.ApprovalForce), nil
+	}
+
+	state, verifier, err := newOAuthState(user.Id)
+	if err != nil {
+		return "", err
+	}
+	return oAuthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256")), nil
 }
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// authorizedStartParam is the parameter of the deep link bringing the
+	// users back to the chat after they authorized the access.
+	authorizedStartParam = "authorized"
+	// oAuthStateTTL is how long an authorization link stays valid.
+	oAuthStateTTL = 15 * time.Minute
+)
+
+var (
+	errInvalidState = errors.New("api: invalid OAuth state")
+	errExpiredState = errors.New("api: expired OAuth state")
+
+	oAuthCallback OAuthCallbackConfig
+	// oAuthStateKey signs the OAuth states. It is generated at startup:
+	// the authorization links sent before a restart are no longer valid.
+	oAuthStateKey []byte
+
+	callbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<html lang="{{.Language}}">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>WorkBot</title></head>
+<body><p>{{.Message}}</p><p><a href="{{.Link}}">{{.Back}}</a></p></body>
+</html>
+`))
+)
+
+// OAuthCallbackConfig holds the configuration of the HTTP endpoint Google
+// redirects the users to after they authorized the access to Google Sheets.
+type OAuthCallbackConfig struct {
+	// RedirectURL is the public URL of the endpoint. When empty, the users
+	// are asked to send the authorization code in the chat instead.
+	RedirectURL string
+	// Listen is the address the HTTP server listens on in polling mode. In
+	// webhook mode the endpoint is served by the webhook server.
+	Listen string
+}
+
+// newOAuthState returns a state identifying the user, signed so that it
+// cannot be forged, and the PKCE code verifier derived from it.
+func newOAuthState(userId int) (string, string, error) {
+	nonce := make([]byte, 12)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", "", err
+	}
+
+	payload := fmt.Sprintf("%d.%d.%s", userId, time.Now().Add(oAuthStateTTL).Unix(),
+		base64.RawURLEncoding.EncodeToString(nonce))
+	return payload + "." + signOAuthState("state:"+payload), signOAuthState("pkce:" + payload), nil
+}
+
+// verifyOAuthState checks the signature and the expiration of state, and
+// returns the ID of the user and the PKCE code verifier.
+func verifyOAuthState(state string) (int, string, error) {
+	i := strings.LastIndex(state, ".")
+	if i < 0 {
+		return 0, "", errInvalidState
+	}
+	payload, signature := state[:i], state[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signOAuthState("state:"+payload))) {
+		return 0, "", errInvalidState
+	}
+
+	fields := strings.Split(payload, ".")
+	if len(fields) != 3 {
+		return 0, "", errInvalidState
+	}
+	userId, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", errInvalidState
+	}
+	expiry, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, "", errInvalidState
+	}
+	if time.Now().Unix() > expiry {
+		return 0, "", errExpiredState
+	}
+
+	return userId, signOAuthState("pkce:" + payload), nil
+}
+
+func signOAuthState(s string) string {
+	mac := hmac.New(sha256.New, oAuthStateKey)
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// codeChallenge returns the S256 PKCE code challenge of verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// codeVerifierTransport adds the PKCE code verifier to the token requests,
+// which the vendored oauth2 package cannot do by itself.
+type codeVerifierTransport struct {
+	verifier string
+	next     http.RoundTripper
+}
+
+func (t *codeVerifierTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	v, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	v.Set("code_verifier", t.verifier)
+	body = []byte(v.Encode())
+
+	r = r.Clone(r.Context())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return t.next.RoundTrip(r)
+}
+
+// deepLink returns the link opening the chat with the bot, sending it
+// /start with the given parameter.
+func deepLink(param string) string {
+	link := "https://t.me/" + telegramBot.Self.UserName
+	if param != "" {
+		link += "?start=" + url.QueryEscape(param)
+	}
+	return link
+}
+
+// oAuthCallbackHandler returns the handler receiving the authorization
+// codes from Google. The tokens are stored by d, in order with the updates
+// of the user, who is then sent back to the chat.
+func oAuthCallbackHandler(d *dispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		userId, verifier, err := verifyOAuthState(q.Get("state"))
+		if err != nil {
+			logrus.Warnf("Rejected OAuth callback from %s: %s", r.RemoteAddr, err.Error())
+			writeCallbackPage(w, r, http.StatusBadRequest, "Il link di autorizzazione non è valido o è scaduto. Torna su Telegram e richiedine uno nuovo.")
+			return
+		}
+
+		log := logrus.WithField("user", userId)
+
+		if e := q.Get("error"); e != "" {
+			log.Infof("User did not authorize the access to Google Sheets: %s", e)
+			writeCallbackPage(w, r, http.StatusOK, "Non hai concesso l'accesso a Google Sheets. Torna su Telegram per riprovare.")
+			return
+		}
+
+		token, err := getToken(q.Get("code"), verifier)
+		if err != nil {
+			log.Warnf("Could not exchange authorization code: %s", err.Error())
+			writeCallbackPage(w, r, http.StatusBadGateway, "Non è stato possibile ottenere l'autorizzazione. Torna su Telegram e riprova.")
+			return
+		}
+
+		d.dispatchFunc(userId, func() {
+			completeAuthorization(log, userId, token)
+		})
+		http.Redirect(w, r, deepLink(authorizedStartParam), http.StatusSeeOther)
+	})
+}
+
+// writeCallbackPage writes the page telling the outcome of the authorization,
+// in the language preferred by the browser of the user.
+func writeCallbackPage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	lang := detectLanguage(strings.SplitN(r.Header.Get("Accept-Language"), ",", 2)[0])
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := callbackPage.Execute(w, struct{ Language, Message, Link, Back string }{
+		string(lang),
+		translate(lang, message),
+		deepLink(""),
+		translate(lang, "Torna a WorkBot"),
+	})
+	if err != nil {
+		logrus.Errorf("Could not write OAuth callback page: %s", err.Error())
+	}
+}
+
+// completeAuthorization stores the token of the user, if they are still
+// waiting for it, and moves them on.
+func completeAuthorization(log *logrus.Entry, userId int, token *oauth2.Token) {
+	var user *types.User
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic: %v\n%s", r, debug.Stack())
+			if user != nil {
+				replyError(log, user, fmt.Errorf("panic: %v", r))
+			}
+		}
+	}()
+
+	user, err := userdb.GetUser(userId)
+	if err != nil {
+		log.Errorf("Could not get user: %s", err.Error())
+		return
+	}
+
+	if user.State != types.UserSetupClientSecret {
+		log.Info("User is not waiting for an authorization, discarding the token")
+		return
+	}
+
+	handleError(log, user, authorize(user, token))
+}
+
+// startOAuthCallbackServer serves the OAuth callback on its own in polling
+// mode. It returns nil if the callback is not configured.
+func startOAuthCallbackServer(d *dispatcher) (*httpServer, error) {
+	if oAuthCallback.RedirectURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(oAuthCallback.RedirectURL)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(urlPath(u), oAuthCallbackHandler(d))
+
+	logrus.Infof("Listening for OAuth callbacks on %s", oAuthCallback.Listen)
+	return startHTTPServer(oAuthCallback.Listen, "", "", mux), nil
+}
+
+// exchangeContext returns the context of the token requests, adding the
+// PKCE code verifier if not empty.
+func exchangeContext(verifier string) context.Context {
+	ctx := context.Background()
+	if verifier == "" {
+		return ctx
+	}
+	client := &http.Client{Transport: &codeVerifierTransport{verifier, http.DefaultTransport}}
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOAuthState(t *testing.T) {
+	oAuthStateKey = []byte("0123456789abcdef0123456789abcdef")
+	defer func() { oAuthStateKey = nil }()
+
+	state, verifier, err := newOAuthState(42)
+	if err != nil {
+		t.Fatalf("could not create the state: %s", err)
+	}
+	userId, got, err := verifyOAuthState(state)
+	if err != nil || userId != 42 || got != verifier {
+		t.Errorf("valid state: got %d, %q, %v, want 42, %q", userId, got, err, verifier)
+	}
+
+	// The verifier is not derivable from the state without the key
+	if strings.Contains(state, verifier) {
+		t.Error("the state holds the code verifier")
+	}
+
+	// signed returns a state with the given payload, signed with the key
+	signed := func(payload string) string {
+		return payload + "." + signOAuthState("state:"+payload)
+	}
+	i := strings.LastIndex(state, ".")
+	payload := state[:i]
+	forged := strings.Replace(payload, "42.", "43.", 1)
+	expired := fmt.Sprintf("42.%d.nonce", time.Now().Add(-time.Minute).Unix())
+
+	tests := []struct {
+		name  string
+		state string
+		err   error
+	}{
+		{"forged user", forged + state[i:], errInvalidState},
+		{"forged signature", payload + ".AAAA", errInvalidState},
+		{"no signature", payload, errInvalidState},
+		{"empty", "", errInvalidState},
+		{"code verifier as signature", "42.1.nonce." + signOAuthState("pkce:42.1.nonce"), errInvalidState},
+		{"malformed payload", signed("42.nonce"), errInvalidState},
+		{"malformed user", signed(fmt.Sprintf("x.%d.nonce", time.Now().Add(time.Minute).Unix())), errInvalidState},
+		{"malformed expiry", signed("42.x.nonce"), errInvalidState},
+		{"expired", signed(expired), errExpiredState},
+	}
+	for _, tt := range tests {
+		if _, _, err := verifyOAuthState(tt.state); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// The states signed before a restart are no longer valid
+	oAuthStateKey = []byte("fedcba9876543210fedcba9876543210")
+	if _, _, err := verifyOAuthState(state); err != errInvalidState {
+		t.Errorf("state signed with the old key: got %v, want %v", err, errInvalidState)
+	}
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"math/rand"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	outboxBaseDelay      = 15 * time.Second
+	outboxMaxDelay       = time.Hour
+	outboxRateLimitDelay = time.Minute
+	outboxMaxAttempts    = 10
+	outboxPollInterval   = 30 * time.Second
+)
+
+var (
+	// outboxWakeUp is signalled when a job is enqueued, so that it is
+	// processed without waiting for the next poll.
+	outboxWakeUp = make(chan struct{}, 1)
+)
+
+// enqueueSync schedules the write of the month date belongs to to the
+// user's timesheet.
+func enqueueSync(user *types.User, date time.Time) error {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	err = userdb.EnqueueSyncJob(user.Id, date.In(loc).Format("2006-01"))
+	if err != nil {
+		return err
+	}
+
+	wakeUpOutbox()
+
+	return nil
+}
+
+func wakeUpOutbox() {
+	select {
+	case outboxWakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// runOutbox processes the outbox until stop is closed. The jobs run through
+// d, in order with the updates of their users.
+func runOutbox(d *dispatcher, stop <-chan struct{}) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		processOutbox(d, stop)
+
+		select {
+		case <-stop:
+			return
+		case <-outboxWakeUp:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processOutbox runs the sync jobs that are due, rescheduling the failed
+// ones with an exponential backoff.
+func processOutbox(d *dispatcher, stop <-chan struct{}) {
+	jobs, err := userdb.GetDueSyncJobs(time.Now())
+	if err != nil {
+		logrus.Errorf("Could not get sync jobs: %s", err.Error())
+		return
+	}
+
+	for i := range jobs {
+		select {
+		case <-stop:
+			// The remaining jobs will run at the next start
+			return
+		default:
+		}
+		runSyncJob(d, &jobs[i])
+	}
+}
+
+// runSyncJob runs job in the queue of its user in d, so that it does not
+// overlap their updates, and waits for it to be done.
+func runSyncJob(d *dispatcher, job *types.SyncJob) {
+	done := make(chan struct{})
+	d.dispatchFunc(job.UserId, func() {
+		defer close(done)
+		syncJob(job)
+	})
+	<-done
+}
+
+// syncJob writes the month of job to the user's timesheet, then deletes the
+// job or reschedules it if the write failed.
+func syncJob(job *types.SyncJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Recovered from panic while syncing %s of user '%d': %v\n%s", job.Month, job.UserId, r, debug.Stack())
+		}
+	}()
+
+	user, err := userdb.GetUser(job.UserId)
+	if err == nil {
+		var loc *time.Location
+		loc, err = time.LoadLocation(user.TimeZone)
+		if err == nil {
+			var month time.Time
+			month, err = time.ParseInLocation("2006-01", job.Month, loc)
+			if err == nil {
+				err = syncMonth(user, month)
+			}
+		}
+	}
+
+	if err == nil {
+		if job.Attempts > 0 {
+			logrus.Infof("Synced %s of user '%d' after %d failed attempts", job.Month, job.UserId, job.Attempts)
+		}
+		err = userdb.DeleteSyncJob(job)
+		if err != nil {
+			logrus.Errorf("Could not delete sync job %d: %s", job.Id, err.Error())
+		}
+		return
+	}
+
+	job.LastError = err.Error()
+
+	if needsAuthorization(err) {
+		// The job is rescheduled when the user authorizes the access again
+		logrus.Infof("Postponing sync of %s of user '%d' until they authorize the access to Google Sheets again", job.Month, job.UserId)
+		if user.State != types.UserSetupClientSecret {
+			err = reauthorize(user)
+			if err != nil {
+				logrus.Errorf("Could not ask user '%d' to authorize the access to Google Sheets again: %s", job.UserId, err.Error())
+			}
+		}
+		job.NextAttempt = time.Now().Add(outboxMaxDelay).UTC()
+		err = userdb.UpdateSyncJob(job)
+		if err != nil {
+			logrus.Errorf("Could not update sync job %d: %s", job.Id, err.Error())
+		}
+		return
+	}
+
+	job.Attempts++
+
+	if job.Attempts >= outboxMaxAttempts {
+		logrus.Errorf("Giving up syncing %s of user '%d' after %d attempts: %s", job.Month, job.UserId, job.Attempts, err.Error())
+		err = userdb.DeleteSyncJob(job)
+		if err != nil {
+			logrus.Errorf("Could not delete sync job %d: %s", job.Id, err.Error())
+		}
+		if user != nil && user.Id != 0 {
+			err = reply(user, "Non sono riuscito ad aggiornare il tuo foglio di calcolo con gli orari di %s. I tuoi orari sono comunque al sicuro: il foglio verrà aggiornato alla prossima registrazione.", job.Month)
+			if err != nil {
+				logrus.Warnf("Could not notify user '%d' of the failed sync: %s", job.UserId, err.Error())
+			}
+		}
+		return
+	}
+
+	delay := syncRetryDelay(job.Attempts, err)
+	job.NextAttempt = time.Now().Add(delay).UTC()
+	logrus.Warnf("Could not sync %s of user '%d' (attempt %d), retrying in %s: %s", job.Month, job.UserId, job.Attempts, delay, err.Error())
+
+	err = userdb.UpdateSyncJob(job)
+	if err != nil {
+		logrus.Errorf("Could not update sync job %d: %s", job.Id, err.Error())
+	}
+}
+
+// syncRetryDelay computes how long to wait before the next attempt of a job
+// that failed attempts times, the last one with err.
+func syncRetryDelay(attempts int, err error) time.Duration {
+	delay := outboxMaxDelay
+	if attempts < 16 {
+		delay = outboxBaseDelay << uint(attempts-1)
+	}
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+
+	if apiErr, ok := err.(*googleapi.Error); ok && isRateLimited(apiErr) {
+		retryAfter := outboxRateLimitDelay
+		if s, err := strconv.Atoi(apiErr.Header.Get("Retry-After")); err == nil && s > 0 {
+			retryAfter = time.Duration(s) * time.Second
+		}
+		if delay < retryAfter {
+			delay = retryAfter
+		}
+	}
+
+	// Spread the retries of jobs that failed together
+	return delay + time.Duration(rand.Int63n(int64(delay/5)+1))
+}
+
+func isRateLimited(err *googleapi.Error) bool {
+	if err.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if err.Code == http.StatusForbidden {
+		for _, e := range err.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+func TestRunSyncJobWaitsForUpdates(t *testing.T) {
+	openTestDB(t)
+
+	d := newDispatcher(4)
+	release := make(chan struct{})
+	updateDone := false
+	d.dispatchFunc(1, func() {
+		<-release
+		updateDone = true
+	})
+
+	jobDone := make(chan struct{})
+	go func() {
+		// The user does not exist, so the job fails without syncing
+		runSyncJob(d, &types.SyncJob{Id: 1, UserId: 1, Month: "2020-01"})
+		close(jobDone)
+	}()
+
+	select {
+	case <-jobDone:
+		t.Fatal("sync job ran before the pending update of the user")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-jobDone
+	if !updateDone {
+		t.Error("sync job returned before the pending update was handled")
+	}
+	d.wait()
+}
@@ -0,0 +1,398 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+const (
+	// punchCallback prefixes the data of the buttons of the punch picker.
+	punchCallback = "punch"
+	// undoCallback prefixes the data of the buttons undoing a punch.
+	undoCallback = "undo"
+	// punchPickerStep is the granularity of the minutes of the picker.
+	punchPickerStep = 5
+)
+
+var errInvalidPunchTime = errors.New("api: invalid punch time")
+
+// parsePunchTime parses the time of a punch given as "18:05", optionally
+// preceded by a day: "oggi", "ieri", "altroieri", "15/10", "15/10/2018"
+// or "2018-10-15". now is the current time in the user's time zone.
+func parsePunchTime(s string, now time.Time) (time.Time, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 || len(fields) > 2 {
+		return time.Time{}, errInvalidPunchTime
+	}
+
+	clock, err := time.Parse("15:04", strings.Replace(fields[len(fields)-1], ".", ":", 1))
+	if err != nil {
+		return time.Time{}, errInvalidPunchTime
+	}
+
+	day := now
+	if len(fields) == 2 {
+		day, err = parsePunchDay(fields[0], now)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location()), nil
+}
+
+func parsePunchDay(s string, now time.Time) (time.Time, error) {
+	switch s {
+	case "oggi", "today":
+		return now, nil
+	case "ieri", "yesterday":
+		return now.AddDate(0, 0, -1), nil
+	case "altroieri", "l'altroieri":
+		return now.AddDate(0, 0, -2), nil
+	}
+
+	for _, layout := range []string{"2/1/2006", "2006-01-02"} {
+		day, err := time.ParseInLocation(layout, s, now.Location())
+		if err == nil {
+			return day, nil
+		}
+	}
+
+	day, err := time.ParseInLocation("2/1", s, now.Location())
+	if err != nil {
+		return time.Time{}, errInvalidPunchTime
+	}
+	day = time.Date(now.Year(), day.Month(), day.Day(), 0, 0, 0, 0, now.Location())
+	if day.After(now) {
+		// A day without year cannot be in the future
+		day = day.AddDate(-1, 0, 0)
+	}
+	return day, nil
+}
+
+// formatPunchDay describes the day of t relative to now, e.g. "ieri".
+func formatPunchDay(user *types.User, t time.Time, now time.Time) string {
+	y, m, d := t.Date()
+	switch {
+	case now.Year() == y && now.Month() == m && now.Day() == d:
+		return tr(user, "oggi")
+	case now.AddDate(0, 0, -1).Format("2006-01-02") == t.Format("2006-01-02"):
+		return tr(user, "ieri")
+	}
+	return trf(user, "il %s", t.Format("02/01/2006"))
+}
+
+// handlePunch records or corrects a punch of the given kind at the time
+// given in args.
+func handlePunch(user *types.User, kind types.EventKind, args string, recordedBy int) error {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+
+	date, err := parsePunchTime(args, now)
+	if err == errInvalidPunchTime {
+		return reply(user, "Non riesco a capire l'orario. Scrivi ad esempio /enter 08:40, /exit ieri 18:05 oppure /enter 15/10 08:40.")
+	}
+	if err != nil {
+		return err
+	}
+
+	return recordPunch(user, kind, date, recordedBy)
+}
+
+// recordPunch records or corrects a punch of the given kind at date, then
+// tells the user how it went.
+func recordPunch(user *types.User, kind types.EventKind, date time.Time, recordedBy int) error {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+	date = date.In(loc)
+
+	messages := punchMessages[kind]
+
+	event, replaced, err := registerPunch(user, kind, date, recordedBy)
+	switch err {
+	case nil:
+	case errFuturePunch:
+		return reply(user, "Non posso registrare timbrature nel futuro!")
+	case errPunchExists:
+		return reply(user, messages.exists, formatPunchDay(user, date, now), date.Format("15:04"))
+	case errNoEnter:
+		return reply(user, "Non trovo un ingresso a cui associare l'uscita di %s alle %s. Registra prima l'ingresso.", formatPunchDay(user, date, now), date.Format("15:04"))
+	case errLongInterval:
+		return reply(user, "L'uscita di %s alle %s chiuderebbe un intervallo di più di %d ore. Registra prima l'ingresso.", formatPunchDay(user, date, now), date.Format("15:04"), int(maxIntervalLength.Hours()))
+	case errOverlap:
+		return reply(user, messages.overlaps, formatPunchDay(user, date, now), date.Format("15:04"))
+	default:
+		return err
+	}
+
+	notice := handleSync(user, date)
+	// The punch may move between months, and the exit of a night shift
+	// belongs to the month the shift started
+	if replaced != nil {
+		handleSync(user, replaced.Time)
+	}
+	if kind == types.ExitEvent {
+		handleSync(user, date.Add(-maxIntervalLength))
+	}
+
+	if replaced != nil {
+		old := replaced.Time.In(loc)
+		return replyWithUndo(user, event, messages.corrected,
+			formatPunchDay(user, old, now), old.Format("15:04"), formatPunchDay(user, date, now), date.Format("15:04"), notice)
+	}
+	return replyWithUndo(user, event, messages.recorded, formatPunchDay(user, date, now), date.Format("15:04"), notice)
+}
+
+// punchMessages are the messages about the punches of each kind, written
+// as whole sentences so that every language can agree them with the kind.
+var punchMessages = map[types.EventKind]struct {
+	recorded, corrected, exists, overlaps, undone, restored string
+}{
+	types.EnterEvent: {
+		recorded:  "Ingresso di %s alle %s registrato.%s",
+		corrected: "Ingresso corretto: da %s alle %s a %s alle %s.%s",
+		exists:    "L'ingresso di %s alle %s è già registrato.",
+		overlaps:  "L'ingresso di %s alle %s cade dentro un intervallo già registrato. Correggi prima il suo ingresso o la sua uscita.",
+		undone:    "Ingresso di %s alle %s annullato.%s",
+		restored:  "Correzione annullata: l'ingresso è tornato a %s alle %s.%s",
+	},
+	types.ExitEvent: {
+		recorded:  "Uscita di %s alle %s registrata.%s",
+		corrected: "Uscita corretta: da %s alle %s a %s alle %s.%s",
+		exists:    "L'uscita di %s alle %s è già registrata.",
+		overlaps:  "L'uscita di %s alle %s cade dentro un intervallo già registrato. Correggi prima il suo ingresso o la sua uscita.",
+		undone:    "Uscita di %s alle %s annullata.%s",
+		restored:  "Correzione annullata: l'uscita è tornata a %s alle %s.%s",
+	},
+}
+
+// replyWithUndo replies to user with a button to undo event.
+func replyWithUndo(user *types.User, event *types.Event, format string, data ...interface{}) error {
+	mc := createReply(user, format, data...)
+	mc.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(tr(user, "↩️ Annulla"), fmt.Sprintf("%s|%d", undoCallback, event.Id)),
+		),
+	)
+	return send(mc)
+}
+
+func handleUndo(user *types.User, msg *tgbotapi.Message) error {
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	err = undo(user, 0, nil)
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
+
+// handleUndoCallback undoes the punch confirmed by the message holding the
+// button, if it is still the last one.
+func handleUndoCallback(user *types.User, cq *tgbotapi.CallbackQuery) error {
+	fields := strings.Split(cq.Data, "|")
+	if len(fields) != 2 {
+		return unexpectedCallback(cq)
+	}
+	id, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return unexpectedCallback(cq)
+	}
+
+	return undo(user, id, cq.Message)
+}
+
+// undo reverts the last punch of user, which must have the given ID if not
+// zero, then tells the user how it went. button is the message holding the
+// undo button, if any: the button is removed once the punch is reverted.
+func undo(user *types.User, id int64, button *tgbotapi.Message) error {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+
+	reverted, restored, err := undoPunch(user, id)
+	switch err {
+	case nil:
+	case errNoUndo:
+		if id != 0 {
+			return reply(user, "Puoi annullare solo la tua ultima timbratura.")
+		}
+		return reply(user, "Non c'è nessuna timbratura da annullare.")
+	case errUndoExpired:
+		return reply(user, "Puoi annullare una timbratura solo entro %d minuti da quando l'hai registrata. Per correggerla usa /enter o /exit seguiti dall'orario giusto.", int(UndoWindow.Minutes()))
+	default:
+		return err
+	}
+
+	date := reverted.Time.In(loc)
+	notice := handleSync(user, date)
+	if reverted.Kind == types.ExitEvent {
+		handleSync(user, date.Add(-maxIntervalLength))
+	}
+
+	if restored != nil {
+		handleSync(user, restored.Time)
+	}
+
+	if button != nil {
+		err = send(tgbotapi.NewEditMessageReplyMarkup(button.Chat.ID, button.MessageID, tgbotapi.NewInlineKeyboardMarkup()))
+		if err != nil {
+			return err
+		}
+	}
+
+	if restored != nil {
+		old := restored.Time.In(loc)
+		return reply(user, punchMessages[restored.Kind].restored, formatPunchDay(user, old, now), old.Format("15:04"), notice)
+	}
+	return reply(user, punchMessages[reverted.Kind].undone, formatPunchDay(user, date, now), date.Format("15:04"), notice)
+}
+
+// handlePunchPicker sends the inline time picker to record or correct a
+// punch.
+func handlePunchPicker(user *types.User, msg *tgbotapi.Message) error {
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+
+	mc := createReply(user, "Quale timbratura vuoi registrare o correggere? Puoi anche scrivere ad esempio /enter 08:40 oppure /exit ieri 18:05.")
+	mc.ReplyMarkup = punchDayKeyboard(user, now)
+	return send(mc)
+}
+
+func punchDayKeyboard(user *types.User, now time.Time) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := 0; i < 3; i++ {
+		day := now.AddDate(0, 0, -i)
+		label := formatPunchDay(user, day, now)
+		data := day.Format("2006-01-02")
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s %s", tr(user, workStart), label), punchData("in", data)),
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s %s", tr(user, workEnd), label), punchData("out", data)),
+		))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func punchHourKeyboard(prefix string) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for h := 0; h < 24; h += 6 {
+		var row []tgbotapi.InlineKeyboardButton
+		for i := h; i < h+6; i++ {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%02d", i), punchData(prefix, fmt.Sprintf("%02d", i))))
+		}
+		rows = append(rows, row)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(back, punchData("cancel"))))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func punchMinuteKeyboard(prefix string) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for m := 0; m < 60; m += 6 * punchPickerStep {
+		var row []tgbotapi.InlineKeyboardButton
+		for i := m; i < m+6*punchPickerStep; i += punchPickerStep {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf(":%02d", i), punchData(prefix, fmt.Sprintf("%02d", i))))
+		}
+		rows = append(rows, row)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(back, punchData("cancel"))))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// punchData builds the data of a button of the punch picker.
+func punchData(fields ...string) string {
+	return strings.Join(append([]string{punchCallback}, fields...), "|")
+}
+
+// handlePunchCallback moves the punch picker a step forward, from the day
+// to the hour to the minutes, then records the punch.
+func handlePunchCallback(user *types.User, cq *tgbotapi.CallbackQuery) error {
+	fields := strings.Split(cq.Data, "|")[1:]
+	chatId, messageId := cq.Message.Chat.ID, cq.Message.MessageID
+
+	if len(fields) == 0 || fields[0] == "cancel" {
+		return send(tgbotapi.NewEditMessageText(chatId, messageId, tr(user, "Operazione annullata.")))
+	}
+
+	kind := types.EnterEvent
+	name := tr(user, workStart)
+	if fields[0] == "out" {
+		kind = types.ExitEvent
+		name = tr(user, workEnd)
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	if len(fields) < 2 {
+		return unexpectedCallback(cq)
+	}
+	day, err := time.ParseInLocation("2006-01-02", fields[1], loc)
+	if err != nil {
+		return unexpectedCallback(cq)
+	}
+	now := time.Now().In(loc)
+
+	switch len(fields) {
+	case 2:
+		mc := tgbotapi.NewEditMessageText(chatId, messageId, trf(user, "%s di %s: a che ora?", name, formatPunchDay(user, day, now)))
+		kb := punchHourKeyboard(cq.Data[len(punchCallback)+1:])
+		mc.ReplyMarkup = &kb
+		return send(mc)
+	case 3:
+		mc := tgbotapi.NewEditMessageText(chatId, messageId, trf(user, "%s di %s alle %s: e i minuti?", name, formatPunchDay(user, day, now), fields[2]))
+		kb := punchMinuteKeyboard(cq.Data[len(punchCallback)+1:])
+		mc.ReplyMarkup = &kb
+		return send(mc)
+	case 4:
+		hour, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return unexpectedCallback(cq)
+		}
+		minute, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return unexpectedCallback(cq)
+		}
+		err = send(tgbotapi.NewEditMessageText(chatId, messageId, trf(user, "%s di %s alle %02d:%02d.", name, formatPunchDay(user, day, now), hour, minute)))
+		if err != nil {
+			return err
+		}
+		date := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc)
+		return recordPunch(user, kind, date, cq.From.ID)
+	}
+	return unexpectedCallback(cq)
+}
+
+func unexpectedCallback(cq *tgbotapi.CallbackQuery) error {
+	return fmt.Errorf("api: unexpected callback data '%s'", cq.Data)
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+func TestParsePunchTime(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Rome")
+	now := time.Date(2026, time.October, 15, 18, 30, 0, 0, loc)
+
+	tests := []struct {
+		s    string
+		want string
+		err  error
+	}{
+		{"18:05", "2026-10-15 18:05", nil},
+		{"8.05", "2026-10-15 08:05", nil},
+		{"oggi 9:00", "2026-10-15 09:00", nil},
+		{"Ieri 9:00", "2026-10-14 09:00", nil},
+		{"yesterday 9:00", "2026-10-14 09:00", nil},
+		{"altroieri 9:00", "2026-10-13 09:00", nil},
+		{"1/10 9:00", "2026-10-01 09:00", nil},
+		{"1/10/2025 9:00", "2025-10-01 09:00", nil},
+		{"2025-10-01 9:00", "2025-10-01 09:00", nil},
+		// A day without year is never in the future
+		{"20/12 9:00", "2025-12-20 09:00", nil},
+		{"", "", errInvalidPunchTime},
+		{"25:00", "", errInvalidPunchTime},
+		{"domani 9:00", "", errInvalidPunchTime},
+		{"31/02 9:00", "", errInvalidPunchTime},
+		{"ieri alle 9:00", "", errInvalidPunchTime},
+	}
+	for _, tt := range tests {
+		got, err := parsePunchTime(tt.s, now)
+		if err != tt.err {
+			t.Errorf("%q: got error %v, want %v", tt.s, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Location() != loc || got.Format("2006-01-02 15:04") != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUndoCallback(t *testing.T) {
+	openTestDB(t)
+
+	api := &fakeBotAPI{}
+	apiSrv := httptest.NewServer(api)
+	defer apiSrv.Close()
+	err := NewTelegramBot("token", apiSrv.URL, false)
+	if err != nil {
+		t.Fatalf("could not start the bot: %s", err)
+	}
+
+	user := newTestUser()
+	user.Backend = types.Local
+	err = userdb.InsertUser(user)
+	if err != nil {
+		t.Fatalf("could not insert the user: %s", err)
+	}
+	event, _, err := registerPunch(user, types.EnterEvent, time.Now().Add(-time.Hour), user.Id)
+	if err != nil {
+		t.Fatalf("could not register the punch: %s", err)
+	}
+
+	// removed reports whether the undo button has been removed since the
+	// last call
+	calls := 0
+	removed := func() bool {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		found := false
+		for _, m := range api.methods[calls:] {
+			found = found || m == "editMessageReplyMarkup"
+		}
+		calls = len(api.methods)
+		return found
+	}
+	cq := &tgbotapi.CallbackQuery{
+		Data:    fmt.Sprintf("%s|%d", undoCallback, event.Id),
+		Message: &tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: int64(user.Id)}},
+	}
+	removed()
+
+	// The button stays until the undo succeeds
+	window := UndoWindow
+	UndoWindow = 0
+	err = handleUndoCallback(user, cq)
+	UndoWindow = window
+	if err != nil || removed() {
+		t.Errorf("expired undo: got %v, button removed", err)
+	}
+
+	err = handleUndoCallback(user, cq)
+	if err != nil || !removed() {
+		t.Errorf("undo: got %v, button kept", err)
+	}
+	if _, err := userdb.GetLastEvent(user.Id, time.Now()); err != sql.ErrNoRows {
+		t.Errorf("undo: got the punch still recorded, %v", err)
+	}
+}
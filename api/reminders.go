@@ -0,0 +1,222 @@
+package api
+
+import (
+	"database/sql"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reminderCallback prefixes the data of the buttons of the reminders.
+	reminderCallback     = "remind"
+	reminderPollInterval = time.Minute
+	// reminderFollowUp is how long after the theoretical exit the users
+	// still at work are reminded again.
+	reminderFollowUp = time.Hour
+	reminderSnooze   = 15 * time.Minute
+	// reminderExpiry is how late a reminder can be sent, e.g. after a
+	// restart.
+	reminderExpiry = 3 * time.Hour
+)
+
+// reminder is a message to send to a user at a given time, unless they
+// have already been sent it.
+type reminder struct {
+	// name identifies the reminder, e.g. "exit:2018-10-15".
+	name string
+	due  time.Time
+	kind types.EventKind
+	text string
+}
+
+// dueReminders returns the reminders of user as of now, in the order they
+// become due: to clock in by the end of the access window on working days,
+// to clock out at the theoretical exit and again later.
+func dueReminders(user *types.User, now time.Time) ([]reminder, error) {
+	record, err := currentRecord(user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if record == nil {
+		if !isWorkingDay(user, now) || user.WorkDuration(now) == 0 || !hasAccessWindow(user) {
+			return nil, nil
+		}
+		h, m, _ := user.AccessEnd.Clock()
+		return []reminder{{
+			name: "enter:" + now.Format("2006-01-02"),
+			due:  time.Date(now.Year(), now.Month(), now.Day(), h, m, 0, 0, now.Location()),
+			kind: types.EnterEvent,
+			text: trf(user, "Non hai ancora timbrato l'ingresso e sono passate le %s. Sei al lavoro?", user.AccessEnd.Format("15:04")),
+		}}, nil
+	}
+
+	if record.HasExit() {
+		return nil, nil
+	}
+
+	exit := record.TheoreticalExit(user.WorkDuration(record.Enter()))
+	worked := formatHours(record.WorkedAt(now))
+	return []reminder{
+		{
+			name: "exit:" + record.Date,
+			due:  exit,
+			kind: types.ExitEvent,
+			text: trf(user, "Sono le %s, l'ora della tua uscita teorica: hai lavorato %s. Ricordati di timbrare l'uscita!", exit.Format("15:04"), worked),
+		},
+		{
+			name: "overtime:" + record.Date,
+			due:  exit.Add(reminderFollowUp),
+			kind: types.ExitEvent,
+			text: trf(user, "Sei ancora al lavoro? Hai lavorato %s, l'uscita teorica era alle %s. Non dimenticare di timbrare l'uscita!", worked, exit.Format("15:04")),
+		},
+	}, nil
+}
+
+// runReminders sends the reminders that are due until stop is closed.
+func runReminders(d *dispatcher, stop <-chan struct{}) {
+	runScheduler(d, stop, reminderPollInterval, userdb.GetUserIds, sendReminders)
+}
+
+// sendReminders sends to the user with the given ID the last of their
+// reminders that is due, unless it has already been sent and not snoozed.
+func sendReminders(id int) {
+	log := logrus.WithField("user", id)
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic while sending reminders: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	user, err := userdb.GetUser(id)
+	if err != nil {
+		log.Errorf("Could not get user: %s", err.Error())
+		return
+	}
+	if !isSetUp(user) {
+		return
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		log.Errorf("Could not load time zone: %s", err.Error())
+		return
+	}
+	now := time.Now().In(loc)
+
+	reminders, err := dueReminders(user, now)
+	if needsAuthorization(err) {
+		// The reminders resume once the user authorizes the access again
+		return
+	}
+	if err != nil {
+		log.Errorf("Could not compute reminders: %s", err.Error())
+		return
+	}
+
+	// A later reminder supersedes the earlier ones
+	var r *reminder
+	for i := range reminders {
+		if !now.Before(reminders[i].due) {
+			r = &reminders[i]
+		}
+	}
+	if r == nil {
+		return
+	}
+
+	sent, err := userdb.GetReminder(user.Id, r.name)
+	if err == sql.ErrNoRows {
+		if now.Sub(r.due) > reminderExpiry {
+			return
+		}
+		sent = &types.Reminder{UserId: user.Id, Name: r.name}
+	} else if err != nil {
+		log.Errorf("Could not get reminder: %s", err.Error())
+		return
+	} else if sent.SnoozedUntil.IsZero() || now.Before(sent.SnoozedUntil) {
+		return
+	}
+
+	action := tr(user, "✅ Timbra l'ingresso")
+	if r.kind == types.ExitEvent {
+		action = tr(user, "✅ Timbra l'uscita")
+	}
+	mc := createReply(user, "%s", r.text)
+	mc.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(action, reminderData("punch", r.name)),
+			tgbotapi.NewInlineKeyboardButtonData(trf(user, "⏰ Tra %d minuti", int(reminderSnooze.Minutes())), reminderData("snooze", r.name)),
+		),
+	)
+	err = send(mc)
+	if e, ok := err.(*telegramError); ok && e.isBlocked() {
+		log.Infof("User cannot be reached: %s", err.Error())
+	} else if err != nil {
+		log.Errorf("Could not send reminder: %s", err.Error())
+		return
+	}
+
+	sent.SentAt = now
+	sent.SnoozedUntil = time.Time{}
+	err = userdb.SaveReminder(sent)
+	if err != nil {
+		log.Errorf("Could not record reminder: %s", err.Error())
+	}
+}
+
+// reminderData builds the data of a button of a reminder.
+func reminderData(action string, name string) string {
+	return strings.Join([]string{reminderCallback, action, name}, "|")
+}
+
+// handleReminderCallback punches now or snoozes the reminder of the
+// button.
+func handleReminderCallback(user *types.User, cq *tgbotapi.CallbackQuery) error {
+	fields := strings.Split(cq.Data, "|")
+	if len(fields) != 3 {
+		return unexpectedCallback(cq)
+	}
+	action, name := fields[1], fields[2]
+
+	sent, err := userdb.GetReminder(user.Id, name)
+	if err == sql.ErrNoRows {
+		return unexpectedCallback(cq)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The buttons can be used once
+	err = send(tgbotapi.NewEditMessageReplyMarkup(cq.Message.Chat.ID, cq.Message.MessageID, tgbotapi.NewInlineKeyboardMarkup()))
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "punch":
+		if strings.HasPrefix(name, "enter:") {
+			return clockIn(user, time.Now())
+		}
+		return clockOut(user, time.Now())
+	case "snooze":
+		loc, err := time.LoadLocation(user.TimeZone)
+		if err != nil {
+			return err
+		}
+		sent.SnoozedUntil = time.Now().In(loc).Add(reminderSnooze)
+		err = userdb.SaveReminder(sent)
+		if err != nil {
+			return err
+		}
+		return reply(user, "Va bene, te lo ricorderò alle %s.", sent.SnoozedUntil.Format("15:04"))
+	}
+	return unexpectedCallback(cq)
+}
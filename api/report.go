@@ -0,0 +1,383 @@
+package api
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/goodsign/monday"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reportCallback prefixes the data of the buttons of the reports.
+	reportCallback = "report"
+	// digestHour is the hour of the day the digests are sent at, once the
+	// period they summarize is over.
+	digestHour         = 9
+	digestPollInterval = 5 * time.Minute
+)
+
+// period is a week, starting on Monday, or a month of a user's timesheet.
+type period struct {
+	kind types.Digest
+	from time.Time
+	to   time.Time
+}
+
+// newPeriod returns the period of the given kind date belongs to.
+func newPeriod(kind types.Digest, date time.Time) period {
+	y, m, d := date.Date()
+	if kind == types.MonthlyDigest {
+		from := time.Date(y, m, 1, 0, 0, 0, 0, date.Location())
+		return period{kind, from, from.AddDate(0, 1, 0)}
+	}
+	from := time.Date(y, m, d-(int(date.Weekday())+6)%7, 0, 0, 0, 0, date.Location())
+	return period{kind, from, from.AddDate(0, 0, 7)}
+}
+
+func (p period) prev() period {
+	return newPeriod(p.kind, p.from.AddDate(0, 0, -1))
+}
+
+func (p period) next() period {
+	return newPeriod(p.kind, p.to)
+}
+
+// key identifies the period, e.g. in the data of the buttons.
+func (p period) key() string {
+	return string(p.kind) + "|" + p.from.Format("2006-01-02")
+}
+
+// format describes the period in the language of user.
+func (p period) format(user *types.User) string {
+	if p.kind == types.MonthlyDigest {
+		return monday.Format(p.from, "January 2006", mondayLocale(user.Language))
+	}
+	return trf(user, "settimana dal %s al %s", p.from.Format("02/01"), p.to.AddDate(0, 0, -1).Format("02/01/2006"))
+}
+
+// report summarizes the working hours of a period.
+type report struct {
+	days         int
+	worked       time.Duration
+	overtime     time.Duration
+	late         []string
+	missingExits []string
+}
+
+// periodRecords returns the records of user in p.
+func periodRecords(user *types.User, p period) ([]types.Record, error) {
+	from, to := p.from.Format("2006-01-02"), p.to.Format("2006-01-02")
+
+	var records []types.Record
+	for month := time.Date(p.from.Year(), p.from.Month(), 1, 0, 0, 0, 0, p.from.Location()); month.Before(p.to); month = month.AddDate(0, 1, 0) {
+		err := importMonth(user, month)
+		if err != nil {
+			return nil, err
+		}
+		monthly, err := monthRecords(user, month)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range monthly {
+			if r.Date >= from && r.Date < to {
+				records = append(records, r)
+			}
+		}
+	}
+	return records, nil
+}
+
+// newReport summarizes records as of now. The overtime balance only counts
+// the closed days, each with the settings in effect on it; a day is late if
+// its first entry is after AccessEnd.
+func newReport(user *types.User, schedules *scheduleHistory, records []types.Record, now time.Time) *report {
+	rep := &report{}
+	for _, r := range records {
+		if len(r.Intervals) == 0 {
+			continue
+		}
+		rep.days++
+		day := r.Enter().Format("02/01")
+
+		if hasAccessWindow(user) && clockDuration(r.Enter()) > clockDuration(user.AccessEnd) {
+			rep.late = append(rep.late, day)
+		}
+
+		if r.HasExit() {
+			rep.worked += r.Worked()
+			rep.overtime += overtime(schedules.at(r.Enter()), r.Enter(), r.Worked())
+			continue
+		}
+		if now.Sub(r.Intervals[len(r.Intervals)-1].Enter) > maxIntervalLength {
+			// The interval has been forgotten: only count the closed ones
+			rep.worked += r.Worked()
+			rep.missingExits = append(rep.missingExits, day)
+		} else {
+			rep.worked += r.WorkedAt(now)
+		}
+	}
+	return rep
+}
+
+func formatReport(user *types.User, p period, rep *report) string {
+	lines := []string{trf(user, "📊 Riepilogo: %s", p.format(user))}
+	if rep.days == 0 {
+		return strings.Join(append(lines, "", tr(user, "Nessuna timbratura registrata.")), "\n")
+	}
+
+	lines = append(lines,
+		"",
+		trf(user, "Giorni lavorati: %d", rep.days),
+		trf(user, "Ore lavorate: %s", formatHours(rep.worked)),
+		trf(user, "Saldo straordinari: %s", formatSignedHours(rep.overtime)),
+		trf(user, "Ingressi in ritardo: %s", formatDays(user, rep.late)),
+		trf(user, "Uscite mancanti: %s", formatDays(user, rep.missingExits)),
+	)
+	if len(rep.missingExits) > 0 {
+		lines = append(lines, "", tr(user, "Registra le uscite mancanti con /exit seguito dal giorno e dall'orario, ad esempio /exit 15/10 18:05."))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatDays formats how many days there are and which ones.
+func formatDays(user *types.User, days []string) string {
+	if len(days) == 0 {
+		return tr(user, "nessuno")
+	}
+	return fmt.Sprintf("%d (%s)", len(days), strings.Join(days, ", "))
+}
+
+// buildReport returns the report of user for p, as of now, with the buttons
+// to move to the other periods.
+func buildReport(user *types.User, p period, now time.Time) (string, *report, tgbotapi.InlineKeyboardMarkup, error) {
+	records, err := periodRecords(user, p)
+	if err != nil {
+		return "", nil, tgbotapi.InlineKeyboardMarkup{}, err
+	}
+	schedules, err := loadScheduleHistory(user)
+	if err != nil {
+		return "", nil, tgbotapi.InlineKeyboardMarkup{}, err
+	}
+	rep := newReport(user, schedules, records, now)
+
+	nav := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("◀️", reportData(p.prev())),
+	)
+	if !p.to.After(now) {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("▶️", reportData(p.next())))
+	}
+	other := newPeriod(types.WeeklyDigest, p.from)
+	name := "📅 Settimana"
+	if p.kind == types.WeeklyDigest {
+		other = newPeriod(types.MonthlyDigest, p.from)
+		name = "🗓 Mese"
+	}
+	kb := tgbotapi.NewInlineKeyboardMarkup(
+		nav,
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(tr(user, name), reportData(other))),
+	)
+
+	return formatReport(user, p, rep), rep, kb, nil
+}
+
+// reportData builds the data of a button showing the report of p.
+func reportData(p period) string {
+	return reportCallback + "|" + p.key()
+}
+
+func handleReport(user *types.User, msg *tgbotapi.Message) error {
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+
+	kind := types.WeeklyDigest
+	if msg.Command() == "month" {
+		kind = types.MonthlyDigest
+	}
+
+	text, _, kb, err := buildReport(user, newPeriod(kind, now), now)
+	if err != nil {
+		return err
+	}
+	mc := createReply(user, "%s", text)
+	mc.ReplyMarkup = kb
+	err = send(mc)
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
+
+// handleReportCallback shows the report of the period of the button in
+// place of the current one.
+func handleReportCallback(user *types.User, cq *tgbotapi.CallbackQuery) error {
+	fields := strings.Split(cq.Data, "|")
+	if len(fields) != 3 {
+		return unexpectedCallback(cq)
+	}
+	kind := types.Digest(fields[1])
+	if kind != types.WeeklyDigest && kind != types.MonthlyDigest {
+		return unexpectedCallback(cq)
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	date, err := time.ParseInLocation("2006-01-02", fields[2], loc)
+	if err != nil {
+		return unexpectedCallback(cq)
+	}
+
+	text, _, kb, err := buildReport(user, newPeriod(kind, date), time.Now().In(loc))
+	if err != nil {
+		return err
+	}
+	mc := tgbotapi.NewEditMessageText(cq.Message.Chat.ID, cq.Message.MessageID, text)
+	mc.ReplyMarkup = &kb
+	return send(mc)
+}
+
+// runDigests sends the digests that are due until stop is closed.
+func runDigests(d *dispatcher, stop <-chan struct{}) {
+	runScheduler(d, stop, digestPollInterval, userdb.GetDigestUserIds, sendDigest)
+}
+
+// sendDigest sends to the user with the given ID the report of the last
+// period, once it is over, unless it has already been sent.
+func sendDigest(id int) {
+	log := logrus.WithField("user", id)
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic while sending digest: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	user, err := userdb.GetUser(id)
+	if err != nil {
+		log.Errorf("Could not get user: %s", err.Error())
+		return
+	}
+	if user.Digest == types.NoDigest || !isSetUp(user) {
+		return
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		log.Errorf("Could not load time zone: %s", err.Error())
+		return
+	}
+	now := time.Now().In(loc)
+
+	p := newPeriod(user.Digest, now).prev()
+	if now.Before(p.to.Add(digestHour * time.Hour)) {
+		return
+	}
+	sent, err := userdb.IsDigestSent(user.Id, p.key())
+	if err != nil || sent {
+		if err != nil {
+			log.Errorf("Could not check digest: %s", err.Error())
+		}
+		return
+	}
+
+	text, rep, kb, err := buildReport(user, p, now)
+	if needsAuthorization(err) {
+		// The digest is sent once the user authorizes the access again
+		log.Info("Postponing digest until the user authorizes the access to Google Sheets again")
+		return
+	}
+	if err != nil {
+		log.Errorf("Could not build digest: %s", err.Error())
+		return
+	}
+
+	// Nothing to summarize, e.g. during the holidays
+	if rep.days > 0 {
+		mc := createReply(user, "%s", text)
+		mc.ReplyMarkup = kb
+		err = send(mc)
+		if e, ok := err.(*telegramError); ok && e.isBlocked() {
+			log.Infof("User cannot be reached: %s", err.Error())
+		} else if err != nil {
+			log.Errorf("Could not send digest: %s", err.Error())
+			return
+		}
+	}
+
+	err = userdb.MarkDigestSent(user.Id, p.key())
+	if err != nil {
+		log.Errorf("Could not record digest: %s", err.Error())
+	}
+}
+
+var digestNames = map[types.Digest]string{
+	types.NoDigest:      "nessuno",
+	types.WeeklyDigest:  "settimanale",
+	types.MonthlyDigest: "mensile",
+}
+
+// digestName returns the name of digest in the language of user.
+func digestName(user *types.User, digest types.Digest) string {
+	return tr(user, digestNames[digest])
+}
+
+func handleSetDigest(user *types.User, msg *tgbotapi.Message) error {
+	if msg == nil {
+		kb := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(strings.Title(digestName(user, types.WeeklyDigest))),
+				tgbotapi.NewKeyboardButton(strings.Title(digestName(user, types.MonthlyDigest))),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(strings.Title(digestName(user, types.NoDigest))),
+			),
+		)
+		kb.OneTimeKeyboard = true
+		mc := createReply(user, "Ogni quanto vuoi ricevere il riepilogo delle tue ore? Lo riceverai alle %d:00 del giorno dopo la fine della settimana o del mese.", digestHour)
+		mc.ReplyMarkup = kb
+		return send(mc)
+	}
+
+	digest, ok := types.NoDigest, false
+	for d, name := range digestNames {
+		if text := strings.TrimSpace(msg.Text); strings.EqualFold(text, name) || strings.EqualFold(text, tr(user, name)) {
+			digest, ok = d, true
+		}
+	}
+	if !ok {
+		return reply(user, "Non riesco a capire cosa hai scritto, prova di nuovo.")
+	}
+
+	user.Digest = digest
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	if digest == types.NoDigest {
+		err = reply(user, "Non riceverai più il riepilogo automatico. Puoi sempre usare /week e /month.")
+	} else {
+		err = reply(user, "Fatto! Riceverai il riepilogo %s.", digestName(user, digest))
+	}
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
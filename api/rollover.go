@@ -0,0 +1,211 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// rolloverAdvance is how long before the new year its timesheet is
+	// created.
+	rolloverAdvance      = 24 * time.Hour
+	rolloverPollInterval = time.Hour
+)
+
+var (
+	// errNoTimesheet is returned for the years before the user started
+	// using WorkBot.
+	errNoTimesheet = errors.New("api: no timesheet for the year")
+
+	// rolloverMu prevents the timesheet of a year from being created twice,
+	// by the outbox and by the scheduler.
+	rolloverMu sync.Mutex
+)
+
+// yearTimesheet returns the identifier of the timesheet of user for year,
+// creating it on the first punch of a new year.
+func yearTimesheet(user *types.User, year int) (string, error) {
+	timesheet, err := userdb.GetTimesheet(user.Id, year)
+	if err != sql.ErrNoRows {
+		return timesheet.SheetId, err
+	}
+
+	rolloverMu.Lock()
+	defer rolloverMu.Unlock()
+
+	// The timesheet may have been created while waiting for the lock
+	timesheet, err = userdb.GetTimesheet(user.Id, year)
+	if err != sql.ErrNoRows {
+		return timesheet.SheetId, err
+	}
+
+	latest, err := userdb.GetLatestTimesheet(user.Id)
+	if err == sql.ErrNoRows || err == nil && year < latest.Year {
+		return "", errNoTimesheet
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sheetId, _, err := createTimesheet(user, year)
+	return sheetId, err
+}
+
+// createTimesheet creates the timesheet of user for year and records it in
+// their history. The timesheet of the latest year becomes the current one,
+// saved in User.SheetId.
+func createTimesheet(user *types.User, year int) (string, string, error) {
+	store, err := timesheetStore(user)
+	if err != nil {
+		return "", "", err
+	}
+
+	sheetId, sheetUrl, err := store.Create(user, year)
+	if err != nil || sheetId == "" {
+		// The local timesheet has no identifier
+		return sheetId, sheetUrl, err
+	}
+
+	err = userdb.SaveTimesheet(&types.Timesheet{UserId: user.Id, Year: year, SheetId: sheetId, SheetUrl: sheetUrl})
+	if err != nil {
+		return "", "", err
+	}
+	latest, err := userdb.GetLatestTimesheet(user.Id)
+	if err != nil {
+		return "", "", err
+	}
+	if latest.Year == year {
+		user.SheetId = sheetId
+		err = userdb.UpdateSheetId(user.Id, sheetId)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	logrus.Infof("Created the timesheet of %d for user '%d'", year, user.Id)
+	return sheetId, sheetUrl, nil
+}
+
+// runRollover creates the timesheets of the new year and sends the
+// summaries of the old one until stop is closed.
+func runRollover(d *dispatcher, stop <-chan struct{}) {
+	runScheduler(d, stop, rolloverPollInterval, userdb.GetUserIds, rollover)
+}
+
+// rollover creates ahead of time the timesheet of the next year of the
+// user with the given ID, then sends them the summary of the last year
+// once it is over.
+func rollover(id int) {
+	log := logrus.WithField("user", id)
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic while rolling over the timesheet: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	user, err := userdb.GetUser(id)
+	if err != nil {
+		log.Errorf("Could not get user: %s", err.Error())
+		return
+	}
+	if user.Backend != types.GoogleSheets || !isSetUp(user) {
+		return
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		log.Errorf("Could not load time zone: %s", err.Error())
+		return
+	}
+	now := time.Now().In(loc)
+
+	_, err = yearTimesheet(user, now.Add(rolloverAdvance).Year())
+	if err == nil {
+		err = sendYearSummary(user, now)
+	}
+	if needsAuthorization(err) {
+		// The timesheet is created once the user authorizes the access
+		// again
+		log.Info("Postponing rollover until the user authorizes the access to Google Sheets again")
+		return
+	}
+	if err != nil && err != errNoTimesheet {
+		log.Errorf("Could not roll over the timesheet: %s", err.Error())
+	}
+}
+
+// sendYearSummary sends to user the summary of the last year, with the link
+// to the timesheet of the new one, unless it has already been sent. It is
+// sent at the hour of the digests to the users who had a timesheet last
+// year.
+func sendYearSummary(user *types.User, now time.Time) error {
+	to := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+	from := to.AddDate(-1, 0, 0)
+	if now.Before(to.Add(digestHour * time.Hour)) {
+		return nil
+	}
+
+	key := "yearly|" + from.Format("2006-01-02")
+	sent, err := userdb.IsDigestSent(user.Id, key)
+	if err != nil || sent {
+		return err
+	}
+
+	last, err := userdb.GetTimesheet(user.Id, from.Year())
+	if err == sql.ErrNoRows {
+		// The user started using WorkBot this year
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = yearTimesheet(user, to.Year())
+	if err != nil {
+		return err
+	}
+	current, err := userdb.GetTimesheet(user.Id, to.Year())
+	if err != nil {
+		return err
+	}
+
+	records, err := periodRecords(user, period{from: from, to: to})
+	if err != nil {
+		return err
+	}
+	schedules, err := loadScheduleHistory(user)
+	if err != nil {
+		return err
+	}
+	rep := newReport(user, schedules, records, now)
+
+	lines := []string{trf(user, "🎆 Buon anno %s! Da oggi registrerò i tuoi orari lavorativi nel nuovo foglio di calcolo per il %d: %s", user.FirstName, to.Year(), current.SheetUrl)}
+	if rep.days > 0 {
+		lines = append(lines,
+			"",
+			trf(user, "📊 Riepilogo: %s", fmt.Sprint(from.Year())),
+			"",
+			trf(user, "Giorni lavorati: %d", rep.days),
+			trf(user, "Ore lavorate: %s", formatHours(rep.worked)),
+			trf(user, "Saldo straordinari: %s", formatSignedHours(rep.overtime)),
+		)
+	}
+	lines = append(lines, "", trf(user, "Il foglio di calcolo del %d resta all'indirizzo: %s", from.Year(), last.SheetUrl))
+
+	err = reply(user, "%s", strings.Join(lines, "\n"))
+	if e, ok := err.(*telegramError); ok && e.isBlocked() {
+		logrus.WithField("user", user.Id).Infof("User cannot be reached: %s", err.Error())
+	} else if err != nil {
+		return err
+	}
+	return userdb.MarkDigestSent(user.Id, key)
+}
@@ -0,0 +1,333 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+const (
+	changeWorkDayFormat   = changeWorkDay + " (%s)"
+	changeWorkDay         = "⏱ Giornata lavorativa"
+	changeExtraWorkFormat = changeExtraWork + " (da %s)"
+	changeExtraWork       = "➕ Soglia straordinario"
+	changeSchedule        = "📅 Orario settimanale"
+	scheduleDone          = "✅ Fatto"
+
+	dayOff       = "libero"
+	standardDay  = "standard"
+	maxWorkDay   = 16 * time.Hour
+	maxExtraWork = 4 * time.Hour
+)
+
+var (
+	errInvalidDuration = errors.New("api: invalid duration")
+
+	// weekdays lists the days in the order of the Italian week.
+	weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+	weekdayNames = map[time.Weekday]string{
+		time.Monday:    "lunedì",
+		time.Tuesday:   "martedì",
+		time.Wednesday: "mercoledì",
+		time.Thursday:  "giovedì",
+		time.Friday:    "venerdì",
+		time.Saturday:  "sabato",
+		time.Sunday:    "domenica",
+	}
+)
+
+// parseClock parses a duration given as "7:42", "7.42" or "7".
+func parseClock(s string) (time.Duration, error) {
+	fields := strings.FieldsFunc(strings.TrimSpace(s), func(r rune) bool { return r == ':' || r == '.' })
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, errInvalidDuration
+	}
+	h, err := strconv.Atoi(fields[0])
+	if err != nil || h < 0 {
+		return 0, errInvalidDuration
+	}
+	m := 0
+	if len(fields) == 2 {
+		m, err = strconv.Atoi(fields[1])
+		if err != nil || m < 0 || m > 59 || len(fields[1]) != 2 {
+			return 0, errInvalidDuration
+		}
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// clockTime returns d as a time of day, as WorkDay and ExtraWorkStart are
+// stored.
+func clockTime(d time.Duration) time.Time {
+	return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Add(d)
+}
+
+// extraWorkThreshold returns the surplus from which the overtime counts.
+// ExtraWorkStart is exclusive, e.g. 0:19:59 for twenty minutes.
+func extraWorkThreshold(user *types.User) time.Duration {
+	return clockDuration(user.ExtraWorkStart).Round(time.Minute)
+}
+
+func handleSetWorkDay(user *types.User, msg *tgbotapi.Message) error {
+	if msg == nil {
+		kb := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton("7:12"),
+				tgbotapi.NewKeyboardButton("7:42"),
+				tgbotapi.NewKeyboardButton("8:00"),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton("4:00"),
+				tgbotapi.NewKeyboardButton("6:00"),
+				tgbotapi.NewKeyboardButton(back),
+			),
+		)
+		kb.OneTimeKeyboard = true
+		mc := createReply(user, "Quanto dura la tua giornata lavorativa? Scegli o scrivimi la durata, ad esempio 7:42. Per i giorni con un orario diverso usa %s.", tr(user, changeSchedule))
+		mc.ReplyMarkup = kb
+		return send(mc)
+	}
+
+	d, err := parseClock(msg.Text)
+	if err != nil || d <= 0 || d > maxWorkDay {
+		return reply(user, "Non riesco a capire la durata, scrivimela ad esempio come 7:42.")
+	}
+
+	user.WorkDay = clockTime(d)
+	return updateSchedule(user, "Fatto! La tua giornata lavorativa dura %s.", formatClock(d))
+}
+
+func handleSetExtraWorkStart(user *types.User, msg *tgbotapi.Message) error {
+	if msg == nil {
+		kb := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton("0:00"),
+				tgbotapi.NewKeyboardButton("0:15"),
+				tgbotapi.NewKeyboardButton("0:20"),
+				tgbotapi.NewKeyboardButton("0:30"),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(back),
+			),
+		)
+		kb.OneTimeKeyboard = true
+		mc := createReply(user, "Da quanto lavoro in più conta lo straordinario? Scegli o scrivimi la durata, ad esempio 0:20. Con 0:00 conta ogni minuto in più.")
+		mc.ReplyMarkup = kb
+		return send(mc)
+	}
+
+	d, err := parseClock(msg.Text)
+	if err != nil || d > maxExtraWork {
+		return reply(user, "Non riesco a capire la durata, scrivimela ad esempio come 0:20.")
+	}
+
+	if d > 0 {
+		d -= time.Second
+	}
+	user.ExtraWorkStart = clockTime(d)
+	return updateSchedule(user, "Fatto! Lo straordinario conta da %s in più.", formatClock(extraWorkThreshold(user)))
+}
+
+// formatSchedule describes the length of the work day of user on each
+// weekday.
+func formatSchedule(user *types.User) string {
+	var lines []string
+	for _, day := range weekdays {
+		d, custom := user.Schedule[day]
+		if !custom {
+			d = clockDuration(user.WorkDay)
+		}
+		name := strings.Title(tr(user, weekdayNames[day]))
+		line := fmt.Sprintf("%s: %s", name, formatClock(d))
+		if d == 0 {
+			line = fmt.Sprintf("%s: %s", name, tr(user, dayOff))
+		}
+		if custom {
+			line += " ✏️"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseWeekday parses a weekday, in Italian or in the language of user,
+// possibly abbreviated, e.g. "ven".
+func parseWeekday(user *types.User, s string) (time.Weekday, bool) {
+	s = strings.NewReplacer("ì", "i", "í", "i").Replace(strings.ToLower(s))
+	if len(s) < 3 {
+		return 0, false
+	}
+	for day, name := range weekdayNames {
+		for _, n := range []string{name, strings.ToLower(tr(user, name))} {
+			if strings.HasPrefix(strings.Replace(n, "ì", "i", 1), s) {
+				return day, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func handleSetSchedule(user *types.User, msg *tgbotapi.Message) error {
+	kb := tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(tr(user, scheduleDone)),
+		),
+	)
+
+	if msg == nil {
+		mc := createReply(user, "Ecco il tuo orario settimanale:\n\n%s\n\nPer cambiarlo scrivimi il giorno e la durata, ad esempio «venerdì 6:00» o «sabato %s». Scrivi «venerdì %s» per tornare alla giornata lavorativa di %s.",
+			formatSchedule(user), tr(user, dayOff), tr(user, standardDay), formatClock(clockDuration(user.WorkDay)))
+		mc.ReplyMarkup = kb
+		return send(mc)
+	}
+
+	if isButton(user, msg.Text, scheduleDone) {
+		user.State = types.Main
+		err := userdb.UpdateUser(user)
+		if err != nil {
+			return err
+		}
+		return handleMessage(user, nil)
+	}
+
+	fields := strings.Fields(msg.Text)
+	errMsg := createReply(user, "Non riesco a capire cosa hai scritto. Scrivimi ad esempio «venerdì 6:00», oppure premi %s.", tr(user, scheduleDone))
+	errMsg.ReplyMarkup = kb
+	if len(fields) != 2 {
+		return send(errMsg)
+	}
+	day, ok := parseWeekday(user, fields[0])
+	if !ok {
+		return send(errMsg)
+	}
+
+	schedule := types.Schedule{}
+	for k, v := range user.Schedule {
+		schedule[k] = v
+	}
+	switch keyword := strings.ToLower(fields[1]); {
+	case keyword == standardDay || keyword == tr(user, standardDay):
+		delete(schedule, day)
+	case keyword == dayOff || keyword == tr(user, dayOff):
+		schedule[day] = 0
+	default:
+		d, err := parseClock(fields[1])
+		if err != nil || d > maxWorkDay {
+			return send(errMsg)
+		}
+		schedule[day] = d
+	}
+	user.Schedule = schedule
+
+	err := saveSchedule(user)
+	if err != nil {
+		return err
+	}
+	text := tr(user, "Fatto! Ecco il tuo orario settimanale:") + "\n\n" + formatSchedule(user)
+	if notice := syncCurrentMonth(user); notice != "" {
+		text += "\n\n" + strings.TrimSpace(notice)
+	}
+	mc := createReply(user, "%s", text)
+	mc.ReplyMarkup = kb
+	return send(mc)
+}
+
+// updateSchedule saves the work day settings of user, confirms them with
+// the given message and goes back to the main menu.
+func updateSchedule(user *types.User, format string, data ...interface{}) error {
+	user.State = types.Main
+	err := saveSchedule(user)
+	if err != nil {
+		return err
+	}
+
+	err = reply(user, "%s%s", trf(user, format, data...), syncCurrentMonth(user))
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
+
+// firstScheduleDay is the day the settings in use before the first change
+// apply from.
+const firstScheduleDay = "0001-01-01"
+
+// saveSchedule saves user along with their work day settings, which apply
+// from today on: the earlier days keep the settings in effect when they
+// were worked.
+func saveSchedule(user *types.User) error {
+	history, err := userdb.GetWorkSchedules(user.Id)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		// Up to now the stored settings applied to every day
+		stored, err := userdb.GetUser(user.Id)
+		if err != nil {
+			return err
+		}
+		initial := stored.WorkSchedule()
+		initial.EffectiveFrom = firstScheduleDay
+		err = userdb.SaveWorkSchedule(initial)
+		if err != nil {
+			return err
+		}
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	current := user.WorkSchedule()
+	current.EffectiveFrom = time.Now().In(loc).Format("2006-01-02")
+	err = userdb.SaveWorkSchedule(current)
+	if err != nil {
+		return err
+	}
+
+	return userdb.UpdateUser(user)
+}
+
+// scheduleHistory tells the work day settings of a user in effect on each
+// day.
+type scheduleHistory struct {
+	user    *types.User
+	changes []types.WorkSchedule
+}
+
+func loadScheduleHistory(user *types.User) (*scheduleHistory, error) {
+	changes, err := userdb.GetWorkSchedules(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &scheduleHistory{user, changes}, nil
+}
+
+// at returns the work day settings in effect on the day of date, in the
+// time zone of the user.
+func (h *scheduleHistory) at(date time.Time) *types.WorkSchedule {
+	day := date.Format("2006-01-02")
+	for i := len(h.changes) - 1; i >= 0; i-- {
+		if h.changes[i].EffectiveFrom <= day {
+			return &h.changes[i]
+		}
+	}
+	return h.user.WorkSchedule()
+}
+
+// syncCurrentMonth rewrites the current month of the timesheet of user,
+// whose figures depend on the schedule, and returns the notice of
+// handleSync.
+func syncCurrentMonth(user *types.User) string {
+	if !isSetUp(user) {
+		return ""
+	}
+	return handleSync(user, time.Now())
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		err  error
+	}{
+		{"7:42", 7*time.Hour + 42*time.Minute, nil},
+		{"7.42", 7*time.Hour + 42*time.Minute, nil},
+		{" 7 ", 7 * time.Hour, nil},
+		{"0:20", 20 * time.Minute, nil},
+		{"7:5", 0, errInvalidDuration},
+		{"7:60", 0, errInvalidDuration},
+		{"-1:00", 0, errInvalidDuration},
+		{"1:2:3", 0, errInvalidDuration},
+		{"", 0, errInvalidDuration},
+		{"sette", 0, errInvalidDuration},
+	}
+	for _, tt := range tests {
+		got, err := parseClock(tt.s)
+		if err != tt.err || got != tt.want {
+			t.Errorf("%q: got %s, %v, want %s, %v", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestScheduleHistoryAt(t *testing.T) {
+	user := &types.User{WorkDay: clockTime(6 * time.Hour)}
+	history := &scheduleHistory{user, []types.WorkSchedule{
+		{EffectiveFrom: firstScheduleDay, WorkDay: clockTime(8 * time.Hour)},
+		{EffectiveFrom: "2026-10-12", WorkDay: clockTime(7 * time.Hour), Schedule: types.Schedule{time.Friday: 4 * time.Hour}},
+	}}
+
+	tests := []struct {
+		date string
+		want time.Duration
+	}{
+		{"2026-10-09", 8 * time.Hour},
+		{"2026-10-11", 8 * time.Hour},
+		{"2026-10-12", 7 * time.Hour},
+		{"2026-10-16", 4 * time.Hour},
+	}
+	for _, tt := range tests {
+		date, _ := time.Parse("2006-01-02", tt.date)
+		if got := history.at(date).WorkDuration(date); got != tt.want {
+			t.Errorf("work day of %s: got %s, want %s", tt.date, got, tt.want)
+		}
+	}
+
+	// Without a history the current settings apply to every day
+	empty := &scheduleHistory{user, nil}
+	date, _ := time.Parse("2006-01-02", "2020-01-01")
+	if got := empty.at(date).WorkDuration(date); got != 6*time.Hour {
+		t.Errorf("work day without history: got %s, want 6h", got)
+	}
+}
+
+func TestOvertime(t *testing.T) {
+	schedule := &types.WorkSchedule{
+		WorkDay:        clockTime(7*time.Hour + 42*time.Minute),
+		ExtraWorkStart: clockTime(20*time.Minute - time.Second),
+	}
+	date := time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		worked time.Duration
+		want   time.Duration
+	}{
+		{7*time.Hour + 42*time.Minute, 0},
+		{8 * time.Hour, 0},
+		{8*time.Hour + 2*time.Minute, 20 * time.Minute},
+		{7 * time.Hour, -42 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := overtime(schedule, date, tt.worked); got != tt.want {
+			t.Errorf("overtime of %s: got %s, want %s", tt.worked, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"time"
+
+	"github.com/lnovara/workbot/types"
+	"github.com/sirupsen/logrus"
+)
+
+// runScheduler runs f for each of the users returned by users, every
+// interval until stop is closed. f is run by d, in order with the updates
+// of the user.
+func runScheduler(d *dispatcher, stop <-chan struct{}, interval time.Duration, users func() ([]int, error), f func(id int)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ids, err := users()
+		if err != nil {
+			logrus.Errorf("Could not get the scheduled users: %s", err.Error())
+		}
+		for _, id := range ids {
+			id := id
+			d.dispatchFunc(id, func() {
+				f(id)
+			})
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isSetUp reports whether user has completed the setup of their
+// timesheet, so that they can record their working hours.
+func isSetUp(user *types.User) bool {
+	switch user.State {
+	case types.UserSetupTimezone, types.UserSetupBackend, types.UserSetupClientSecret:
+		return false
+	}
+	// The local timesheet has no identifier
+	return user.Backend == types.Local || user.SheetId != ""
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const httpShutdownTimeout = 10 * time.Second
+
+// httpServer is an HTTP server running in the background.
+type httpServer struct {
+	srv *http.Server
+	// err receives the error that made the server stop serving.
+	err chan error
+}
+
+// startHTTPServer serves handler on addr, over HTTPS if certFile and
+// keyFile are given.
+func startHTTPServer(addr string, certFile string, keyFile string, handler http.Handler) *httpServer {
+	s := &httpServer{
+		srv: &http.Server{
+			Addr:    addr,
+			Handler: handler,
+		},
+		err: make(chan error, 1),
+	}
+
+	go func() {
+		if certFile != "" {
+			s.err <- s.srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			s.err <- s.srv.ListenAndServe()
+		}
+	}()
+
+	return s
+}
+
+// serveUntil waits for stop to be closed, then shuts the server down
+// gracefully. It returns early if the server stops serving on its own.
+func (s *httpServer) serveUntil(stop <-chan struct{}) error {
+	select {
+	case <-stop:
+	case err := <-s.err:
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+// urlPath returns the path u is served at by a ServeMux.
+func urlPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	sheets "google.golang.org/api/sheets/v4"
+)
+
+const (
+	summarySheetTitle = "Riepilogo"
+	// summaryMonth is the month the summary sheet is saved with among the
+	// sheets of the months.
+	summaryMonth = 0
+	// summaryTotalRow is the index of the row of the yearly totals, after
+	// the headers and the months.
+	summaryTotalRow = 13
+)
+
+// summaryHeaders are the headers of the columns of the summary sheet.
+var summaryHeaders = []string{"Mese",
+	"Giorni lavorati",
+	"Totale",
+	"Straordinario",
+	"Saldo straordinari",
+	"Ingresso medio",
+	"Uscita media"}
+
+// sheetTitle returns the title of the sheet of the given month, or of the
+// summary sheet, in the language of the spreadsheet of user.
+func sheetTitle(user *types.User, month int) string {
+	if month == summaryMonth {
+		return translate(user.SheetLanguage, summarySheetTitle)
+	}
+	return monthSheetTitle(user, time.Date(2000, time.Month(month), 1, 0, 0, 0, 0, time.UTC))
+}
+
+// sheetTitles returns the titles the sheet of the given month, or the
+// summary sheet, may have in any language, in lower case.
+func sheetTitles(month int) []string {
+	var titles []string
+	for _, lang := range languages {
+		user := &types.User{SheetLanguage: lang}
+		titles = append(titles, strings.ToLower(sheetTitle(user, month)))
+	}
+	return titles
+}
+
+// sheetReference returns the reference to a range of the sheet with the
+// given title, to be used in formulas.
+func sheetReference(title string, cells string) string {
+	return fmt.Sprintf("'%s'!%s", strings.Replace(title, "'", "''", -1), cells)
+}
+
+// setUpSummarySheet formats the sheet with the given ID as the summary
+// sheet.
+func setUpSummarySheet(srv *sheets.Service, spreadsheetId string, sheetId int64) error {
+	bold := &sheets.CellData{
+		UserEnteredFormat: &sheets.CellFormat{
+			TextFormat: &sheets.TextFormat{
+				Bold: true,
+			},
+		},
+	}
+
+	r := []*sheets.Request{
+		{
+			RepeatCell: &sheets.RepeatCellRequest{
+				Cell:   bold,
+				Fields: "userEnteredFormat.textFormat",
+				Range: &sheets.GridRange{
+					SheetId:         sheetId,
+					StartRowIndex:   0,
+					EndRowIndex:     1,
+					ForceSendFields: []string{"SheetId"},
+				},
+			},
+		},
+		{
+			RepeatCell: &sheets.RepeatCellRequest{
+				Cell:   bold,
+				Fields: "userEnteredFormat.textFormat",
+				Range: &sheets.GridRange{
+					SheetId:         sheetId,
+					StartRowIndex:   summaryTotalRow,
+					EndRowIndex:     summaryTotalRow + 1,
+					ForceSendFields: []string{"SheetId"},
+				},
+			},
+		},
+		{
+			RepeatCell: &sheets.RepeatCellRequest{
+				Cell: &sheets.CellData{
+					UserEnteredFormat: &sheets.CellFormat{
+						NumberFormat: &sheets.NumberFormat{
+							Type:    "TIME",
+							Pattern: "[h]:mm:ss",
+						},
+					},
+				},
+				Fields: "userEnteredFormat.numberFormat",
+				Range: &sheets.GridRange{
+					SheetId:          sheetId,
+					StartRowIndex:    1,
+					StartColumnIndex: 2,
+					EndColumnIndex:   5,
+					ForceSendFields:  []string{"SheetId"},
+				},
+			},
+		},
+		{
+			RepeatCell: &sheets.RepeatCellRequest{
+				Cell: &sheets.CellData{
+					UserEnteredFormat: &sheets.CellFormat{
+						NumberFormat: &sheets.NumberFormat{
+							Type:    "TIME",
+							Pattern: "h:mm",
+						},
+					},
+				},
+				Fields: "userEnteredFormat.numberFormat",
+				Range: &sheets.GridRange{
+					SheetId:          sheetId,
+					StartRowIndex:    1,
+					StartColumnIndex: 5,
+					EndColumnIndex:   7,
+					ForceSendFields:  []string{"SheetId"},
+				},
+			},
+		},
+		{
+			UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+				Fields: "gridProperties.frozenRowCount",
+				Properties: &sheets.SheetProperties{
+					GridProperties: &sheets.GridProperties{
+						FrozenRowCount: 1,
+					},
+					SheetId:         sheetId,
+					ForceSendFields: []string{"SheetId"},
+				},
+			},
+		},
+	}
+
+	busr := &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: r,
+	}
+	_, err := srv.Spreadsheets.BatchUpdate(spreadsheetId, busr).Do()
+	return err
+}
+
+// writeSummarySheet writes the formulas of the summary sheet of the given
+// spreadsheet of user for year. Each month counts the days worked, the total
+// and the overtime of the rows of its sheet holding a date, so that the
+// totals at the bottom of the months are left out; the overtime balance is
+// carried from a month to the next, and from the previous years to January.
+func writeSummarySheet(srv *sheets.Service, user *types.User, spreadsheetId string, year int) error {
+	carried, err := carriedBalance(user, year)
+	if err != nil {
+		return err
+	}
+
+	spreadsheet, err := srv.Spreadsheets.Get(spreadsheetId).Fields("sheets.properties").Do()
+	if err != nil {
+		return err
+	}
+	titles := make(map[int64]string)
+	for _, s := range spreadsheet.Sheets {
+		titles[s.Properties.SheetId] = s.Properties.Title
+	}
+
+	summary, err := userdb.GetMonthSheet(user.Id, spreadsheetId, summaryMonth)
+	if err != nil {
+		return err
+	}
+
+	var headers []interface{}
+	for _, h := range summaryHeaders {
+		headers = append(headers, translate(user.SheetLanguage, h))
+	}
+	values := [][]interface{}{headers}
+
+	for month := 1; month <= 12; month++ {
+		sheet, err := userdb.GetMonthSheet(user.Id, spreadsheetId, month)
+		if err != nil {
+			return err
+		}
+		title := titles[sheet.SheetId]
+		dates := sheetReference(title, "A2:A")
+		row := month + 1
+
+		balance := carriedFormula(carried, fmt.Sprintf("D%d", row))
+		if month > 1 {
+			balance = fmt.Sprintf("=E%d + D%d", row-1, row)
+		}
+		values = append(values, []interface{}{sheetTitle(user, month),
+			fmt.Sprintf("=COUNTIF(%s, \">0\")", dates),
+			fmt.Sprintf("=SUMIF(%s, \">0\", %s)", dates, sheetReference(title, "E2:E")),
+			fmt.Sprintf("=SUMIF(%s, \">0\", %s)", dates, sheetReference(title, "F2:F")),
+			balance,
+			fmt.Sprintf("=IFERROR(AVERAGEIF(%s, \">0\", %s), \"\")", dates, sheetReference(title, "B2:B")),
+			fmt.Sprintf("=IFERROR(AVERAGEIF(%s, \">0\", %s), \"\")", dates, sheetReference(title, "D2:D")),
+		})
+	}
+
+	values = append(values, []interface{}{translate(user.SheetLanguage, "Totale"),
+		fmt.Sprintf("=SUM(B2:B%d)", summaryTotalRow),
+		fmt.Sprintf("=SUM(C2:C%d)", summaryTotalRow),
+		fmt.Sprintf("=SUM(D2:D%d)", summaryTotalRow),
+		fmt.Sprintf("=E%d", summaryTotalRow),
+	})
+
+	busr := &sheets.BatchUpdateValuesByDataFilterRequest{
+		Data: []*sheets.DataFilterValueRange{{
+			DataFilter: sheetRange(summary.SheetId, 0, 0, 0),
+			Values:     values,
+		}},
+		ValueInputOption: "USER_ENTERED",
+	}
+	_, err = srv.Spreadsheets.Values.BatchUpdateByDataFilter(spreadsheetId, busr).Do()
+	return err
+}
+
+// carriedBalance returns the overtime balance user closed the years before
+// year with, counting the years they had a timesheet for.
+func carriedBalance(user *types.User, year int) (time.Duration, error) {
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return 0, err
+	}
+
+	timesheets, err := userdb.GetTimesheets(user.Id)
+	if err != nil {
+		return 0, err
+	}
+	schedules, err := loadScheduleHistory(user)
+	if err != nil {
+		return 0, err
+	}
+
+	var balance time.Duration
+	for _, t := range timesheets {
+		if t.Year >= year {
+			continue
+		}
+		from := time.Date(t.Year, time.January, 1, 0, 0, 0, 0, loc)
+		to := from.AddDate(1, 0, 0)
+		records, err := periodRecords(user, period{from: from, to: to})
+		if err != nil {
+			return 0, err
+		}
+		balance += newReport(user, schedules, records, to).overtime
+	}
+	return balance, nil
+}
+
+// carriedFormula returns the formula adding the balance carried from the
+// previous years to the overtime in the given cell.
+func carriedFormula(carried time.Duration, cell string) string {
+	switch {
+	case carried > 0:
+		return fmt.Sprintf("=\"%s\" + %s", formatDuration(carried), cell)
+	case carried < 0:
+		return fmt.Sprintf("=%s - \"%s\"", cell, formatDuration(-carried))
+	}
+	return "=" + cell
+}
+
+// syncCarriedBalance writes again the summary of the year after the one of
+// date, if user already has its timesheet, as it carries over the balance
+// of the year of date.
+func syncCarriedBalance(user *types.User, date time.Time) error {
+	next, err := userdb.GetTimesheet(user.Id, date.Year()+1)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	srv, err := sheetsClientPool.get(user)
+	if err != nil {
+		return err
+	}
+	return writeSummarySheet(srv, user, next.SheetId, next.Year)
+}
+
+// BackfillSummaries writes again the summary sheets of the timesheets of
+// user, from the oldest one, adding them to the spreadsheets lacking one.
+// The months are left as they are.
+func BackfillSummaries(user *types.User) error {
+	if user.Backend != types.GoogleSheets {
+		return nil
+	}
+	srv, err := sheetsClientPool.get(user)
+	if err != nil {
+		return err
+	}
+	timesheets, err := userdb.GetTimesheets(user.Id)
+	if err != nil {
+		return err
+	}
+	for _, t := range timesheets {
+		err = repairMonthSheets(srv, user, t.SheetId, t.Year)
+		if err == nil {
+			err = writeSummarySheet(srv, user, t.SheetId, t.Year)
+		}
+		if err != nil {
+			return fmt.Errorf("could not write the summary of %d: %s", t.Year, err.Error())
+		}
+	}
+	return nil
+}
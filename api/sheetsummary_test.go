@@ -0,0 +1,70 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+func TestCarriedFormula(t *testing.T) {
+	tests := []struct {
+		carried time.Duration
+		want    string
+	}{
+		{0, "=D2"},
+		{90 * time.Minute, `="1:30:00" + D2`},
+		{-30 * time.Hour, `=D2 - "30:00:00"`},
+	}
+	for _, tt := range tests {
+		if got := carriedFormula(tt.carried, "D2"); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.carried, got, tt.want)
+		}
+	}
+}
+
+func TestCarriedBalance(t *testing.T) {
+	openTestDB(t)
+	user := newTestUser()
+	user.Backend = types.GoogleSheets
+	user.WorkDay = clockTime(8 * time.Hour)
+	err := userdb.InsertUser(user)
+	if err != nil {
+		t.Fatalf("could not insert the user: %s", err)
+	}
+	for year := 2024; year <= 2026; year++ {
+		err = userdb.SaveTimesheet(&types.Timesheet{UserId: user.Id, Year: year, SheetId: "sheet"})
+		if err != nil {
+			t.Fatalf("could not save the timesheet: %s", err)
+		}
+	}
+
+	appendTestEvents(t, user,
+		// Two hours of overtime in 2024
+		types.EnterEvent, "2024-03-04 08:00",
+		types.ExitEvent, "2024-03-04 18:00",
+		// One hour short in 2025, on the night shift of New Year's Eve
+		types.EnterEvent, "2025-12-31 22:00",
+		types.ExitEvent, "2026-01-01 05:00",
+		// Not carried over
+		types.EnterEvent, "2026-03-02 08:00",
+		types.ExitEvent, "2026-03-02 20:00",
+	)
+
+	tests := []struct {
+		year int
+		want time.Duration
+	}{
+		{2024, 0},
+		{2025, 2 * time.Hour},
+		{2026, time.Hour},
+		{2027, 5 * time.Hour},
+	}
+	for _, tt := range tests {
+		got, err := carriedBalance(user, tt.year)
+		if err != nil || got != tt.want {
+			t.Errorf("%d: got %s, %v, want %s", tt.year, got, err, tt.want)
+		}
+	}
+}
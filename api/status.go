@@ -0,0 +1,88 @@
+package api
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+)
+
+// handleStatus tells the user how their work day is going. The figures are
+// computed from the ledger, so they are live and do not depend on the
+// formulas of the timesheet.
+func handleStatus(user *types.User, msg *tgbotapi.Message) error {
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(loc)
+
+	record, err := currentRecord(user, now)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		err = reply(user, "Oggi non hai ancora effettuato l'ingresso. Usa %s quando arrivi al lavoro.", tr(user, workStart))
+	} else {
+		err = reply(user, "%s", formatStatus(user, record, now))
+	}
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
+
+// formatStatus describes record as of now.
+func formatStatus(user *types.User, record *types.Record, now time.Time) string {
+	day := record.Enter()
+	worked := record.WorkedAt(now)
+	remaining := user.WorkDuration(day) - worked
+
+	lines := []string{
+		trf(user, "📋 Situazione di %s", formatPunchDay(user, day, now)),
+		"",
+		trf(user, "Ingresso: %s", formatSheetTime(day, day)),
+	}
+	if record.Break() > 0 {
+		lines = append(lines, trf(user, "Pausa: %s", formatHours(record.Break())))
+	}
+	lines = append(lines, trf(user, "Lavorato: %s", formatHours(worked)))
+	if remaining > 0 {
+		lines = append(lines, trf(user, "Mancano: %s", formatHours(remaining)))
+	}
+	lines = append(lines,
+		trf(user, "Uscita teorica: %s", formatSheetTime(record.TheoreticalExit(user.WorkDuration(day)), day)),
+		trf(user, "Straordinario: %s", formatSignedHours(overtime(user.WorkSchedule(), day, worked))),
+	)
+
+	lines = append(lines, "")
+	switch {
+	case !record.HasExit():
+		lines = append(lines, tr(user, "Sei al lavoro."))
+	case remaining > 0:
+		lines = append(lines, trf(user, "Sei in pausa dalle %s.", formatSheetTime(record.Exit(), day)))
+	default:
+		lines = append(lines, trf(user, "Uscita effettuata alle %s.", formatSheetTime(record.Exit(), day)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// formatSignedHours formats d as formatHours, with its sign.
+func formatSignedHours(d time.Duration) string {
+	switch {
+	case d < 0:
+		return "-" + formatHours(-d)
+	case d > 0:
+		return "+" + formatHours(d)
+	}
+	return formatHours(d)
+}
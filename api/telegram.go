@@ -4,347 +4,797 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"regexp"
+	"net/http"
+	"net/url"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/lnovara/workbot/types"
 	"github.com/lnovara/workbot/userdb"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 )
 
 const (
-	back                   = "🔙"
-	changeAccessTimeFormat = changeAccessTime + " (da %s - %s)"
-	changeAccessTime       = "🕙 Modifica orario d'ingresso"
-	changeLocationFormat   = changeLocation + " (da %s)"
-	changeLocation         = "🌍 Modifica fuso orario"
-	editSettings           = "🔧 Impostazioni"
-	sendLocation           = "🌍 Invia posizione"
-	workEnd                = "Uscita"
-	workStart              = "Ingresso"
+	back                    = "🔙"
+	backendGoogleSheets     = "📊 Google Sheets"
+	backendLocal            = "💾 Solo su WorkBot"
+	changeAccessTimeFormat  = changeAccessTime + " (%s)"
+	changeAccessTime        = "🕙 Modifica orario d'ingresso"
+	changeClosePolicyFormat = changeClosePolicy + " (%s)"
+	changeClosePolicy       = "🌙 Fine giornata"
+	changeDigestFormat      = changeDigest + " (%s)"
+	changeDigest            = "📬 Riepilogo automatico"
+	changeLocationFormat    = changeLocation + " (da %s)"
+	changeLocation          = "🌍 Modifica fuso orario"
+	editPunch               = "🕘 Correggi"
+	editSettings            = "🔧 Impostazioni"
+	sendLocation            = "🌍 Invia posizione"
+	workEnd                 = "Uscita"
+	workStart               = "Ingresso"
 )
 
 var (
 	telegramBot *tgbotapi.BotAPI
 )
 
-// NewTelegramBot initializes a new Telegram bot
-func NewTelegramBot(telegramToken string, debug bool) error {
+// NewTelegramBot initializes a new Telegram bot. If apiURL is not empty,
+// the Bot API requests are sent there instead of api.telegram.org.
+func NewTelegramBot(telegramToken string, apiURL string, debug bool) error {
+	client := &http.Client{}
+	if apiURL != "" {
+		base, err := url.Parse(apiURL)
+		if err != nil {
+			return err
+		}
+		client.Transport = &telegramTransport{base, http.DefaultTransport}
+	}
+
 	var err error
-	telegramBot, err = tgbotapi.NewBotAPI(telegramToken)
+	telegramBot, err = tgbotapi.NewBotAPIWithClient(telegramToken, client)
+	if err != nil {
+		return err
+	}
 	telegramBot.Debug = debug
+	return nil
+}
+
+// HandleBotUpdates handles the updates received with long polling, using
+// at most workers goroutines, until stop is closed. Then it waits for the
+// updates already received to be handled.
+func HandleBotUpdates(workers int, stop <-chan struct{}) error {
+	// Telegram does not allow long polling while a webhook is set
+	_, err := telegramBot.RemoveWebhook()
+	if err != nil {
+		return err
+	}
+
+	d := newDispatcher(workers)
+
+	srv, err := startOAuthCallbackServer(d)
+	if err != nil {
+		return err
+	}
+
+	return runWorkers(d, stop, func() error {
+		if srv == nil {
+			pollUpdates(d, stop)
+			return nil
+		}
+
+		// Stop polling as well if the server fails
+		quit := make(chan struct{})
+		polled := make(chan struct{})
+		go func() {
+			pollUpdates(d, quit)
+			close(polled)
+		}()
+		err := srv.serveUntil(stop)
+		close(quit)
+		<-polled
+		return err
+	})
+}
+
+// runWorkers runs receive, which feeds d with the updates until stop is
+// closed, along with the outbox and the scheduled messages. When receive
+// returns, it waits for the dispatched updates to be handled.
+func runWorkers(d *dispatcher, stop <-chan struct{}, receive func() error) error {
+	// The outbox and the scheduled messages dispatch changes to the users
+	// as well: stop them before waiting for d. The pending sync jobs run at
+	// the next start.
+	done := make(chan struct{})
+	outboxDone := make(chan struct{})
+	go func() {
+		runOutbox(d, done)
+		close(outboxDone)
+	}()
+
+	schedulersStop := make(chan struct{})
+	var schedulers sync.WaitGroup
+	for _, run := range []func(*dispatcher, <-chan struct{}){runDigests, runReminders, runAutoClose, runRollover} {
+		schedulers.Add(1)
+		go func(run func(*dispatcher, <-chan struct{})) {
+			defer schedulers.Done()
+			run(d, schedulersStop)
+		}(run)
+	}
+
+	err := receive()
+
+	close(schedulersStop)
+	close(done)
+	schedulers.Wait()
+	<-outboxDone
+
+	logrus.Info("Waiting for pending updates to be handled...")
+	d.wait()
+
 	return err
 }
 
-// HandleBotUpdates handles bot updates
-func HandleBotUpdates() {
+// pollUpdates fetches the updates with long polling and dispatches them
+// until stop is closed. Updates are confirmed to Telegram only after they
+// have been dispatched, so none is lost on shutdown.
+func pollUpdates(d *dispatcher, stop <-chan struct{}) {
+	type result struct {
+		updates []tgbotapi.Update
+		err     error
+	}
+
 	uc := tgbotapi.NewUpdate(0)
 	uc.Timeout = 60
 
-	updates, err := telegramBot.GetUpdatesChan(uc)
-	if err != nil {
-		logrus.Fatalf("Could not get bot updates chan: %s", err.Error())
-	}
+	for {
+		results := make(chan result, 1)
+		go func(uc tgbotapi.UpdateConfig) {
+			updates, err := telegramBot.GetUpdates(uc)
+			results <- result{updates, err}
+		}(uc)
 
-	for u := range updates {
-		if u.Message == nil {
-			logrus.Infof("nil message")
+		var r result
+		select {
+		case <-stop:
+			return
+		case r = <-results:
+		}
+
+		if r.err != nil {
+			logrus.Warnf("Could not get bot updates, retrying in 3 seconds: %s", r.err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(3 * time.Second):
+			}
 			continue
 		}
 
-		msg := u.Message
-
-		logrus.Debugf("[%d] %s: '%s'", msg.MessageID, msg.From, msg.Text)
-
-		var user *types.User
-		user, err = userdb.GetUser(msg.From.ID)
-		if err != nil && err != sql.ErrNoRows {
-			logrus.Fatalf("Could not get user '%d': %s", msg.From.ID, err.Error())
-		} else if err == sql.ErrNoRows {
-			user = types.NewUser()
-			user.Id = msg.From.ID
-			user.FirstName = msg.From.FirstName
-			err = userdb.InsertUser(user)
-			if err != nil {
-				logrus.Fatalf("Could not add user '%d': %s", msg.From.ID, err.Error())
+		for _, u := range r.updates {
+			if u.UpdateID >= uc.Offset {
+				uc.Offset = u.UpdateID + 1
+				d.dispatch(u)
 			}
 		}
+	}
+}
+
+// handleUpdate handles a single update. Errors and panics are logged and
+// reported to the user without affecting the handling of other updates.
+func handleUpdate(u tgbotapi.Update) {
+	log := logrus.WithField("update", u.UpdateID)
+
+	var user *types.User
 
-		// TODO: use Command() for bot command handling
-		if msg.Text == "/start" {
-			msg = nil
-			user.State = types.UserSetupTimezone
-		} else if msg.Text == "/enter" || msg.Text == workStart {
-			user.State = types.Enter
-		} else if msg.Text == "/exit" || msg.Text == workEnd {
-			user.State = types.Exit
-		} else if msg.Text == "/settings" || msg.Text == editSettings {
-			user.State = types.Settings
-		} else if strings.HasPrefix(msg.Text, changeAccessTime) {
-			msg = nil
-			user.State = types.SetAccessTime
-		} else if strings.HasPrefix(msg.Text, changeLocation) {
-			user.State = types.SetTimezone
-		} else if msg.Text == back {
-			user.State = types.Main
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic: %v\n%s", r, debug.Stack())
+			if user != nil {
+				replyError(log, user, fmt.Errorf("panic: %v", r))
+			}
 		}
+	}()
 
-		err = userdb.UpdateUser(user)
+	if u.CallbackQuery != nil {
+		cq := u.CallbackQuery
+		log = log.WithField("user", cq.From.ID)
+		log.Debugf("%s: callback '%s'", cq.From, cq.Data)
+
+		var err error
+		user, err = getOrInsertUser(cq.From)
 		if err != nil {
-			logrus.Fatalf("Could not update user '%d': %s", user.Id, err.Error())
+			log.Errorf("Could not get user: %s", err.Error())
+			return
 		}
-		handleMessage(user, msg)
+		handleError(log, user, handleCallbackQuery(user, cq))
+		return
+	}
+
+	if u.Message == nil {
+		log.Info("nil message")
+		return
 	}
+
+	msg := u.Message
+	if msg.From == nil {
+		// Messages sent on behalf of a channel have no user to reply to
+		log.Info("message without sender")
+		return
+	}
+
+	log = log.WithField("user", msg.From.ID)
+	log.Debugf("[%d] %s: '%s'", msg.MessageID, msg.From, msg.Text)
+
+	if msg.Command() == "start" && msg.CommandArguments() == authorizedStartParam {
+		// The user came back from the OAuth callback, which has already
+		// moved them on
+		return
+	}
+
+	user, err := getOrInsertUser(msg.From)
+	if err != nil {
+		log.Errorf("Could not get user: %s", err.Error())
+		return
+	}
+
+	if msg.Command() == "start" {
+		msg = nil
+		user.State = types.UserSetupTimezone
+	} else if msg.Command() == "enter" || isButton(user, msg.Text, workStart) {
+		user.State = types.Enter
+	} else if msg.Command() == "exit" || isButton(user, msg.Text, workEnd) {
+		user.State = types.Exit
+	} else if msg.Command() == "punch" || isButton(user, msg.Text, editPunch) {
+		user.State = types.Punch
+	} else if msg.Command() == "undo" {
+		user.State = types.Undo
+	} else if msg.Command() == "status" || msg.Command() == "today" {
+		user.State = types.Status
+	} else if msg.Command() == "week" || msg.Command() == "month" {
+		user.State = types.Report
+	} else if msg.Command() == "settings" || isButton(user, msg.Text, editSettings) {
+		user.State = types.Settings
+	} else if hasButtonPrefix(user, msg.Text, changeAccessTime) {
+		msg = nil
+		user.State = types.SetAccessTime
+	} else if hasButtonPrefix(user, msg.Text, changeWorkDay) {
+		msg = nil
+		user.State = types.SetWorkDay
+	} else if hasButtonPrefix(user, msg.Text, changeExtraWork) {
+		msg = nil
+		user.State = types.SetExtraWorkStart
+	} else if isButton(user, msg.Text, changeSchedule) {
+		msg = nil
+		user.State = types.SetSchedule
+	} else if hasButtonPrefix(user, msg.Text, changeClosePolicy) {
+		msg = nil
+		user.State = types.SetClosePolicy
+	} else if hasButtonPrefix(user, msg.Text, changeDigest) {
+		msg = nil
+		user.State = types.SetDigest
+	} else if hasButtonPrefix(user, msg.Text, changeHolidays) {
+		msg = nil
+		user.State = types.SetHolidays
+	} else if hasButtonPrefix(user, msg.Text, changeLanguage) {
+		msg = nil
+		user.State = types.SetLanguage
+	} else if hasButtonPrefix(user, msg.Text, changeLocation) {
+		user.State = types.SetTimezone
+	} else if msg.Text == back {
+		user.State = types.Main
+	}
+
+	err = userdb.UpdateUser(user)
+	if err == nil {
+		err = handleMessage(user, msg)
+	}
+	handleError(log, user, err)
+}
+
+// handleError reports to the user the error occurred handling their
+// request, moving them back into the authorization flow if needed.
+func handleError(log *logrus.Entry, user *types.User, err error) {
+	if needsAuthorization(err) {
+		log.Info("User has to authorize the access to Google Sheets again")
+		err = reauthorize(user)
+	}
+	if e, ok := err.(*telegramError); ok && e.isBlocked() {
+		log.Infof("User cannot be reached: %s", err.Error())
+	} else if err != nil {
+		log.WithField("state", user.State).Errorf("Could not handle message: %s", err.Error())
+		replyError(log, user, err)
+	}
+}
+
+// handleCallbackQuery handles the buttons of the inline keyboards.
+func handleCallbackQuery(user *types.User, cq *tgbotapi.CallbackQuery) error {
+	// Stop the progress indicator on the button
+	_, err := telegramBot.AnswerCallbackQuery(tgbotapi.NewCallback(cq.ID, ""))
+	if err != nil {
+		return &telegramError{err}
+	}
+
+	if cq.Message == nil || !isSetUp(user) {
+		return nil
+	}
+
+	switch strings.SplitN(cq.Data, "|", 2)[0] {
+	case punchCallback:
+		return handlePunchCallback(user, cq)
+	case undoCallback:
+		return handleUndoCallback(user, cq)
+	case reportCallback:
+		return handleReportCallback(user, cq)
+	case reminderCallback:
+		return handleReminderCallback(user, cq)
+	case accessCallback:
+		return handleAccessCallback(user, cq)
+	}
+	return unexpectedCallback(cq)
 }
 
-func handleMessage(user *types.User, msg *tgbotapi.Message) {
+func getOrInsertUser(from *tgbotapi.User) (*types.User, error) {
+	user, err := userdb.GetUser(from.ID)
+	if err == sql.ErrNoRows {
+		user = types.NewUser()
+		user.Id = from.ID
+		user.FirstName = from.FirstName
+		user.Language = detectLanguage(from.LanguageCode)
+		err = userdb.InsertUser(user)
+	}
+	return user, err
+}
+
+func handleMessage(user *types.User, msg *tgbotapi.Message) error {
 	switch user.State {
 	case types.Main:
-		handleMain(user, msg)
+		return handleMain(user, msg)
 	case types.Enter:
-		handleEnter(user, msg)
+		return handleEnter(user, msg)
 	case types.Exit:
-		handleExit(user, msg)
+		return handleExit(user, msg)
+	case types.Punch:
+		return handlePunchPicker(user, msg)
+	case types.Undo:
+		return handleUndo(user, msg)
+	case types.Status:
+		return handleStatus(user, msg)
+	case types.Report:
+		return handleReport(user, msg)
+	case types.SetDigest:
+		return handleSetDigest(user, msg)
+	case types.SetClosePolicy:
+		return handleSetClosePolicy(user, msg)
+	case types.SetWorkDay:
+		return handleSetWorkDay(user, msg)
+	case types.SetExtraWorkStart:
+		return handleSetExtraWorkStart(user, msg)
+	case types.SetSchedule:
+		return handleSetSchedule(user, msg)
+	case types.SetLanguage:
+		return handleSetLanguage(user, msg)
+	case types.SetHolidays:
+		return handleSetHolidays(user, msg)
 	case types.Settings:
-		handleSettings(user, msg)
+		return handleSettings(user, msg)
 	case types.SetTimezone:
 		fallthrough
 	case types.UserSetupTimezone:
-		handleUserSetupTimeZone(user, msg)
+		return handleUserSetupTimeZone(user, msg)
+	case types.UserSetupBackend:
+		return handleUserSetupBackend(user, msg)
 	case types.UserSetupClientSecret:
-		handleUserSetupClientSecret(user, msg)
+		return handleUserSetupClientSecret(user, msg)
 	case types.SetAccessTime:
 		fallthrough
 	case types.UserSetupAccessTime:
-		handleUserSetupAccessTime(user, msg)
+		return handleUserSetupAccessTime(user, msg)
 	default:
-		reply(user, "state %d unknown/unhandled. Terminating", user.State)
-		logrus.Fatalf("state %d unknown", user.State)
+		err := unexpectedState(user)
+		user.State = types.Main
+		userdb.UpdateUser(user)
+		return err
 	}
 }
 
-func handleMain(user *types.User, msg *tgbotapi.Message) {
+func handleMain(user *types.User, msg *tgbotapi.Message) error {
 	kb := tgbotapi.NewReplyKeyboard(
 		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(workStart),
-			tgbotapi.NewKeyboardButton(workEnd),
-			tgbotapi.NewKeyboardButton(editSettings),
+			tgbotapi.NewKeyboardButton(tr(user, workStart)),
+			tgbotapi.NewKeyboardButton(tr(user, workEnd)),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(tr(user, editPunch)),
+			tgbotapi.NewKeyboardButton(tr(user, editSettings)),
 		),
 	)
 
 	mc := createReply(user, "Scegli quale operazione effettuare.")
 	mc.ReplyMarkup = kb
-	telegramBot.Send(mc)
+	return send(mc)
 }
 
-func handleEnter(user *types.User, msg *tgbotapi.Message) {
-	err := appendEnterTime(user, time.Unix(int64(msg.Date), 0))
+func handleEnter(user *types.User, msg *tgbotapi.Message) error {
+	// Go back to the main menu first, so that a failure does not leave the
+	// user stuck in this state
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
 	if err != nil {
-		if err == errAlreadyEnter {
-			reply(user, "Oggi hai già effettuato l'ingresso, quante volte vuoi entrare?! Vai a lavorare!")
-		} else {
-			logrus.Fatal(err)
+		return err
+	}
+
+	if args := msg.CommandArguments(); args != "" {
+		err = handlePunch(user, types.EnterEvent, args, msg.From.ID)
+		if err != nil {
+			return err
 		}
+		return handleMessage(user, nil)
 	}
-	// FIXME: give feedback about successful insertion and theoretical exit time
-	user.State = types.Main
-	userdb.UpdateUser(user)
-	handleMessage(user, nil)
+
+	err = clockIn(user, time.Unix(int64(msg.Date), 0))
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
 }
 
-func handleExit(user *types.User, msg *tgbotapi.Message) {
-	err := appendExitTime(user, time.Unix(int64(msg.Date), 0))
+// clockIn records that user entered at date and replies with the theoretical
+// exit.
+func clockIn(user *types.User, date time.Time) error {
+	event, record, err := registerEnter(user, date)
+	if err == errAlreadyEnter {
+		return reply(user, "Hai già effettuato l'ingresso, quante volte vuoi entrare?! Vai a lavorare!")
+	} else if err != nil {
+		return err
+	}
+
+	exit := record.TheoreticalExit(user.WorkDuration(record.Enter())).Format("15:04")
+	if len(record.Intervals) > 1 {
+		return replyWithUndo(user, event, "Eccoti di nuovo! Ingresso registrato, dopo %s di pausa l'uscita teorica è alle %s.%s",
+			formatHours(record.Break()), exit, handleSync(user, date))
+	}
+	return replyWithUndo(user, event, "Ingresso registrato, l'uscita teorica è alle %s.%s", exit, handleSync(user, date))
+}
+
+func handleExit(user *types.User, msg *tgbotapi.Message) error {
+	// Go back to the main menu first, so that a failure does not leave the
+	// user stuck in this state
+	user.State = types.Main
+	err := userdb.UpdateUser(user)
 	if err != nil {
-		if err == errNoEnter {
-			reply(user, "Oggi non hai ancora effettuato l'ingresso. Devi entrare prima di poter uscire, no?!")
-		} else if err == errAlreadyExit {
-			reply(user, "Oggi hai già effettuato l'uscita, quante volte vuoi uscire?! Goditi la serata!")
-		} else {
-			logrus.Fatal(err)
+		return err
+	}
+
+	if args := msg.CommandArguments(); args != "" {
+		err = handlePunch(user, types.ExitEvent, args, msg.From.ID)
+		if err != nil {
+			return err
 		}
-	} else {
-		reply(user, "Uscita effettuata con successo. Buona serata!")
+		return handleMessage(user, nil)
 	}
-	user.State = types.Main
-	userdb.UpdateUser(user)
-	handleMessage(user, nil)
+
+	err = clockOut(user, time.Unix(int64(msg.Date), 0))
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
 }
 
-func handleSetAccessTime(user *types.User, msg *tgbotapi.Message) {
-	logrus.Panic("HandleSetAccessTime not implemented!")
+// clockOut records that user exited at date and replies with the time worked.
+func clockOut(user *types.User, date time.Time) error {
+	event, record, err := registerExit(user, date)
+	if err == errNoEnter {
+		return reply(user, "Oggi non hai ancora effettuato l'ingresso. Devi entrare prima di poter uscire, no?!")
+	} else if err == errAlreadyExit {
+		return reply(user, "Hai già effettuato l'uscita, quante volte vuoi uscire?! Per rientrare usa %s.", tr(user, workStart))
+	} else if err != nil {
+		return err
+	}
+
+	greeting := tr(user, "A dopo!")
+	if record.Worked() >= user.WorkDuration(record.Enter()) {
+		greeting = tr(user, "Buona serata!")
+	}
+	// A night shift belongs to the day it started
+	return replyWithUndo(user, event, "Uscita effettuata con successo, oggi hai lavorato %s.%s %s",
+		formatHours(record.Worked()), handleSync(user, record.Enter()), greeting)
+}
+
+// formatHours formats d as hours and minutes, e.g. "7h 42m".
+func formatHours(d time.Duration) string {
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh %02dm", d/time.Hour, d%time.Hour/time.Minute)
 }
 
-func handleSetTimeZone(user *types.User, msg *tgbotapi.Message) {
-	logrus.Panic("HandleSetTimeZone not implemented!")
+// formatClock formats d as hours and minutes, e.g. "7:42".
+func formatClock(d time.Duration) string {
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%d:%02d", d/time.Hour, d%time.Hour/time.Minute)
+}
+
+// handleSync schedules the update of the user's timesheet and returns a
+// notice to append to the confirmation message.
+func handleSync(user *types.User, date time.Time) string {
+	if user.Backend == types.Local {
+		return ""
+	}
+
+	err := enqueueSync(user, date)
+	if err != nil {
+		// The ledger holds the event anyway: the timesheet will be rewritten
+		// with it at the next successful sync.
+		logrus.Errorf("Could not schedule sync of user '%d': %s", user.Id, err.Error())
+	}
+
+	return " " + tr(user, "Sto aggiornando il tuo foglio di calcolo.")
 }
 
-func handleSettings(user *types.User, msg *tgbotapi.Message) {
+func handleSettings(user *types.User, msg *tgbotapi.Message) error {
 	kb := tgbotapi.NewReplyKeyboard(
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton(back),
 		),
 		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(fmt.Sprintf(changeAccessTimeFormat, user.AccessStart.Format("15:04"), user.AccessEnd.Format("15:04"))),
+			tgbotapi.NewKeyboardButton(trf(user, changeAccessTimeFormat, formatAccessWindow(user))),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(trf(user, changeLocationFormat, user.TimeZone)),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(trf(user, changeWorkDayFormat, formatClock(clockDuration(user.WorkDay)))),
+			tgbotapi.NewKeyboardButton(trf(user, changeExtraWorkFormat, formatClock(extraWorkThreshold(user)))),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(tr(user, changeSchedule)),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(trf(user, changeClosePolicyFormat, closePolicyName(user))),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(trf(user, changeDigestFormat, digestName(user, user.Digest))),
 		),
 		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(fmt.Sprintf(changeLocationFormat, user.TimeZone)),
+			tgbotapi.NewKeyboardButton(trf(user, changeHolidaysFormat, holidaysName(user))),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(trf(user, changeLanguageFormat, languageNames[user.Language])),
 		),
 	)
 	kb.OneTimeKeyboard = true
 	mc := createReply(user, "Quali impostazioni vuoi modificare?")
 	mc.ReplyMarkup = kb
-	telegramBot.Send(mc)
+	return send(mc)
 }
 
-func handleUserSetupAccessTime(user *types.User, msg *tgbotapi.Message) {
-	kb := tgbotapi.NewReplyKeyboard()
+func handleUserSetupBackend(user *types.User, msg *tgbotapi.Message) error {
+	kb := tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(tr(user, backendGoogleSheets)),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(tr(user, backendLocal)),
+		),
+	)
 	kb.OneTimeKeyboard = true
-	start := time.Date(2000, time.January, 1, 8, 0, 0, 0, time.UTC)
-	for i := 0; i < 5; i++ {
-		end := start.Add(30 * time.Minute)
-		kb.Keyboard = append(kb.Keyboard, tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(fmt.Sprintf("%s - %s", start.Format("15:04"), end.Format("15:04"))),
-		))
-		start = start.Add(30 * time.Minute)
-	}
-
-	errMsg := createReply(user, "Non riesco a capire cosa hai scritto, prova di nuovo.")
-	errMsg.ReplyMarkup = kb
 
 	if msg == nil {
-		var mc tgbotapi.MessageConfig
-		if user.State == types.UserSetupAccessTime {
-			mc = createReply(user, "Per ultimo, scegli il tuo orario d'ingresso.")
-		} else if user.State == types.SetAccessTime {
-			mc = createReply(user, "Per favore, scegli il tuo orario d'ingresso.")
-		} else {
-			logrus.Panicf("Unexpected state '%d'", user.State)
-		}
+		mc := createReply(user, "Dove vuoi che registri i tuoi orari lavorativi? Puoi usare un foglio di calcolo sul tuo Google Drive oppure tenerli solo su WorkBot.")
 		mc.ReplyMarkup = kb
-		telegramBot.Send(mc)
-	} else {
-		patt := "(.*) - (.*)"
-		m, err := regexp.MatchString(patt, msg.Text)
+		return send(mc)
+	}
+
+	switch {
+	case isButton(user, msg.Text, backendGoogleSheets):
+		user.Backend = types.GoogleSheets
+		user.State = types.UserSetupClientSecret
+	case isButton(user, msg.Text, backendLocal):
+		user.Backend = types.Local
+		user.SheetLanguage = user.Language
+		sheetId, _, err := localStore{}.Create(user, time.Now().Year())
 		if err != nil {
-			logrus.Fatal(err)
-		}
-		if !m {
-			telegramBot.Send(errMsg)
-			return
+			return err
 		}
-		re := regexp.MustCompile(patt)
-		matches := re.FindStringSubmatch(msg.Text)
-		accessStart := matches[1]
-		accessEnd := matches[2]
-		accessStartTime, err := time.Parse("15:04", accessStart)
+		user.SheetId = sheetId
+		user.LedgerStart = time.Now()
+		user.State = types.UserSetupAccessTime
+		err = reply(user, "Perfetto, registrerò i tuoi orari lavorativi solo su WorkBot.")
 		if err != nil {
-			telegramBot.Send(errMsg)
-			return
+			return err
 		}
-		accessEndTime, err := time.Parse("15:04", accessEnd)
+	default:
+		mc := createReply(user, "Non riesco a capire cosa hai scritto, prova di nuovo.")
+		mc.ReplyMarkup = kb
+		return send(mc)
+	}
+
+	err := userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
+}
+
+func handleUserSetupClientSecret(user *types.User, msg *tgbotapi.Message) error {
+	if oAuthCallback.RedirectURL != "" {
+		// The authorization code is received by the OAuth callback
+		link, err := authCodeURL(user)
 		if err != nil {
-			telegramBot.Send(errMsg)
-			return
+			return err
 		}
-		reply(user, "Grazie! Hai scelto la fascia oraria %s.", msg.Text)
-		if user.State == types.UserSetupAccessTime {
-			reply(user, "Congratulazioni %s, ora puoi iniziare ad usare Workbot!", user.FirstName)
-		}
-		user.AccessStart = accessStartTime
-		user.AccessEnd = accessEndTime
-		user.State = types.Main
-		userdb.UpdateUser(user)
-		handleMessage(user, nil)
+		mc := createReply(user, "Per registrare i tuoi orari lavorativi, ho bisogno che tu mi dia l'autorizzazione per accedere a Google Sheets. Per favore, apri il link e concedi l'accesso: al termine tornerai qui.")
+		mc.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonURL(tr(user, "🔑 Autorizza Google Sheets"), link),
+			),
+		)
+		return send(mc)
 	}
-}
 
-func handleUserSetupClientSecret(user *types.User, msg *tgbotapi.Message) {
 	if msg == nil {
-		reply(user, "Per registrare i tuoi orari lavorativi, ho bisogno che tu mi dia l'autorizzazione per accedere a Google Sheets.")
-		reply(user, "Per favore, visita il link e inviami il codice d'autorizzazione: %s", authCodeURL())
-	} else {
-		token, err := getToken(msg.Text)
+		err := reply(user, "Per registrare i tuoi orari lavorativi, ho bisogno che tu mi dia l'autorizzazione per accedere a Google Sheets.")
 		if err != nil {
-			reply(user, "Non è stato possibile ottenere il codice di autorizzazione. Riprova.")
-			handleMessage(user, nil)
-			return
+			return err
+		}
+		link, err := authCodeURL(user)
+		if err != nil {
+			return err
 		}
-		clientSecret, err := json.Marshal(token)
+		return reply(user, "Per favore, visita il link e inviami il codice d'autorizzazione: %s", link)
+	}
+
+	token, err := getToken(msg.Text, "")
+	if err != nil {
+		logrus.Warnf("Could not exchange authorization code of user '%d': %s", user.Id, err.Error())
+		err = reply(user, "Non è stato possibile ottenere il codice di autorizzazione. Riprova.")
 		if err != nil {
-			logrus.Fatalf("Could not marshal client secret: %s", err.Error())
+			return err
 		}
-		user.ClientSecret = clientSecret
+		return handleMessage(user, nil)
+	}
+	return authorize(user, token)
+}
+
+// authorize stores the token the user authorized the access to Google
+// Sheets with, then creates their spreadsheet if they have none.
+func authorize(user *types.User, token *oauth2.Token) error {
+	clientSecret, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	user.ClientSecret = clientSecret
+	sheetsClientPool.drop(user.Id)
+	err = userdb.UpdateClientSecret(user.Id, clientSecret)
+	if err != nil {
+		return err
+	}
+	err = reply(user, "Autorizzazione avvenuta con successo!")
+	if err != nil {
+		return err
+	}
+	if user.SheetId != "" {
+		// The user authorized again the access to an existing spreadsheet:
+		// write the changes that could not be synced in the meantime
+		user.State = types.Main
 		err = userdb.UpdateUser(user)
 		if err != nil {
-			logrus.Fatalf("Could not update user '%d': %s", user.Id, err.Error())
+			return err
 		}
-		reply(user, "Autorizzazione avvenuta con successo!")
-		reply(user, "Adesso creo un nuovo foglio di calcolo sul tuo Google Drive.")
-		reply(user, "Potrebbe volerci qualche secondo...")
-		newSheetsClient(user)
-		sheetId, sheetUrl, err := createSpreadsheet(user)
+		err = userdb.RescheduleSyncJobs(user.Id, time.Now())
 		if err != nil {
-			logrus.Fatalf("Could not create spreadsheet: %s", err.Error())
+			return err
 		}
-		reply(user, "Fatto!")
-		reply(user, "Troverai i tuoi orari lavorativi registrati all'indirizzo: %s", sheetUrl)
-		user.SheetId = sheetId
-		user.State = types.UserSetupAccessTime
-		userdb.UpdateUser(user)
-		handleMessage(user, nil)
+		wakeUpOutbox()
+		return handleMessage(user, nil)
+	}
+	err = reply(user, "Adesso creo un nuovo foglio di calcolo sul tuo Google Drive.")
+	if err != nil {
+		return err
+	}
+	err = reply(user, "Potrebbe volerci qualche secondo...")
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		return err
+	}
+	// The month tabs are named in the language of the spreadsheet
+	user.SheetLanguage = user.Language
+	_, sheetUrl, err := createTimesheet(user, time.Now().In(loc).Year())
+	if err != nil {
+		return err
+	}
+	user.LedgerStart = time.Now()
+	user.State = types.UserSetupAccessTime
+	err = userdb.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+	err = reply(user, "Fatto!")
+	if err != nil {
+		return err
+	}
+	err = reply(user, "Troverai i tuoi orari lavorativi registrati all'indirizzo: %s", sheetUrl)
+	if err != nil {
+		return err
 	}
+	return handleMessage(user, nil)
 }
 
-func handleUserSetupTimeZone(user *types.User, msg *tgbotapi.Message) {
+func handleUserSetupTimeZone(user *types.User, msg *tgbotapi.Message) error {
 	var mc tgbotapi.MessageConfig
 
 	kb := tgbotapi.NewReplyKeyboard(
 		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButtonLocation(sendLocation),
+			tgbotapi.NewKeyboardButtonLocation(tr(user, sendLocation)),
 		),
 	)
 	kb.OneTimeKeyboard = true
 
 	if msg == nil {
-		reply(user, "Ciao %s!", user.FirstName)
+		err := reply(user, "Ciao %s!", user.FirstName)
+		if err != nil {
+			return err
+		}
 		mc = createReply(user, "Per iniziare, iniviami la tua posizione, così che possa determinare il tuo fuso orario!")
 		mc.ReplyMarkup = kb
-		telegramBot.Send(mc)
+		return send(mc)
 	} else if msg.Location == nil {
 		mc = createReply(user, "Per favore, inviami la tua posizione.")
 		mc.ReplyMarkup = kb
-		telegramBot.Send(mc)
+		return send(mc)
+	}
+
+	tzId, err := timezone(msg.Location.Latitude, msg.Location.Longitude, user.Language)
+	if err != nil {
+		return err
+	}
+	user.TimeZone = tzId
+	if user.State == types.SetTimezone {
+		user.State = types.Main
+	} else if user.State == types.UserSetupTimezone {
+		user.State = types.UserSetupBackend
 	} else {
-		tzId, err := timezone(msg.Location.Latitude, msg.Location.Longitude)
-		if err != nil {
-			logrus.Fatalf("Could not get timezone: %s", err.Error())
-		}
-		user.TimeZone = tzId
-		if user.State == types.SetTimezone {
-			user.State = types.Main
-		} else if user.State == types.UserSetupTimezone {
-			user.State = types.UserSetupClientSecret
-		} else {
-			logrus.Panicf("Unexpected state '%d'", user.State)
-		}
-		err = userdb.UpdateUser(user)
-		if err != nil {
-			logrus.Fatalf("Could not update user %d: %s", user.Id, err.Error())
-		}
-		reply(user, "Grazie! Il tuo fuso orario è '%s'.", tzId)
-		handleMessage(user, nil)
+		return unexpectedState(user)
+	}
+	err = userdb.UpdateUser(user)
+	if err != nil {
+		return err
 	}
+	err = reply(user, "Grazie! Il tuo fuso orario è '%s'.", tzId)
+	if err != nil {
+		return err
+	}
+	return handleMessage(user, nil)
 }
 
 func createReply(user *types.User, format string, data ...interface{}) tgbotapi.MessageConfig {
-	return tgbotapi.NewMessage(int64(user.Id), fmt.Sprintf(format, data...))
+	return tgbotapi.NewMessage(int64(user.Id), trf(user, format, data...))
 }
 
-func reply(user *types.User, format string, data ...interface{}) {
-	_, err := telegramBot.Send(createReply(user, format, data...))
+func send(c tgbotapi.Chattable) error {
+	_, err := telegramBot.Send(c)
+	if err != nil {
+		return &telegramError{err}
+	}
+	return nil
+}
+
+func reply(user *types.User, format string, data ...interface{}) error {
+	return send(createReply(user, format, data...))
+}
+
+// replyError tells the user that the handling of their message failed.
+func replyError(log *logrus.Entry, user *types.User, err error) {
+	if _, ok := err.(*telegramError); ok {
+		// There is no point in replying if Telegram refused the message
+		return
+	}
+
+	err = reply(user, "%s", tr(user, friendlyReply(err)))
 	if err != nil {
-		logrus.Fatalf("Could not send reply to '%d': %s", user.Id, err.Error())
+		log.Warnf("Could not send error reply: %s", err.Error())
 	}
 }
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lnovara/workbot/types"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+)
+
+// errorHook records the errors logged.
+type errorHook struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (h *errorHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (h *errorHook) Fire(e *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errors = append(h.errors, e.Message)
+	return nil
+}
+
+func TestHandleUpdate(t *testing.T) {
+	openTestDB(t)
+
+	api := &fakeBotAPI{}
+	apiSrv := httptest.NewServer(api)
+	defer apiSrv.Close()
+	err := NewTelegramBot("token", apiSrv.URL, false)
+	if err != nil {
+		t.Fatalf("could not start the bot: %s", err)
+	}
+
+	hook := &errorHook{}
+	logrus.AddHook(hook)
+	defer func() { logrus.StandardLogger().Hooks = make(logrus.LevelHooks) }()
+
+	user := newTestUser()
+	user.Backend = types.Local
+	err = userdb.InsertUser(user)
+	if err != nil {
+		t.Fatalf("could not insert the user: %s", err)
+	}
+
+	command := func(text string) *tgbotapi.Message {
+		return &tgbotapi.Message{
+			Text:     text,
+			From:     &tgbotapi.User{ID: user.Id},
+			Chat:     &tgbotapi.Chat{ID: int64(user.Id)},
+			Entities: &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(text)}},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		msg   *tgbotapi.Message
+		state types.State
+	}{
+		{"settings", command("/settings"), types.Settings},
+		{"settings addressed to the bot", command("/settings@workbot"), types.Settings},
+		{"start", command("/start"), types.UserSetupTimezone},
+		// A message sent on behalf of a channel is ignored
+		{"without sender", &tgbotapi.Message{Text: "/settings", Chat: &tgbotapi.Chat{ID: -1}}, types.Main},
+	}
+	for _, tt := range tests {
+		user.State = types.Main
+		err = userdb.UpdateUser(user)
+		if err != nil {
+			t.Fatalf("could not reset the user: %s", err)
+		}
+
+		handleUpdate(tgbotapi.Update{UpdateID: 1, Message: tt.msg})
+
+		got, err := userdb.GetUser(user.Id)
+		if err != nil {
+			t.Fatalf("%s: could not get the user: %s", tt.name, err)
+		}
+		if got.State != tt.state {
+			t.Errorf("%s: got state %d, want %d", tt.name, got.State, tt.state)
+		}
+	}
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if len(hook.errors) > 0 {
+		t.Errorf("got errors logged: %v", hook.errors)
+	}
+}
+
+func TestClockInNearMidnight(t *testing.T) {
+	openTestDB(t)
+
+	api := &fakeBotAPI{}
+	apiSrv := httptest.NewServer(api)
+	defer apiSrv.Close()
+	err := NewTelegramBot("token", apiSrv.URL, false)
+	if err != nil {
+		t.Fatalf("could not start the bot: %s", err)
+	}
+
+	user := newTestUser()
+	user.Backend = types.Local
+	user.TimeZone = "Pacific/Auckland"
+	user.WorkDay = time.Date(0, time.January, 1, 8, 0, 0, 0, time.UTC)
+	user.Schedule = types.Schedule{time.Monday: 4 * time.Hour}
+	err = userdb.InsertUser(user)
+	if err != nil {
+		t.Fatalf("could not insert the user: %s", err)
+	}
+
+	// Monday on a server in UTC, already Tuesday for the user
+	err = clockIn(user, time.Date(2026, time.January, 5, 11, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("could not clock in: %s", err)
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.texts) == 0 || !strings.Contains(api.texts[len(api.texts)-1], "08:30") {
+		t.Errorf("got reply %q, want the theoretical exit at 08:30", api.texts)
+	}
+}
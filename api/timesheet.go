@@ -0,0 +1,40 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+var (
+	errUnknownBackend = errors.New("api: unknown timesheet backend")
+
+	timesheetStores = map[types.Backend]TimesheetStore{
+		types.GoogleSheets: sheetsStore{},
+		types.Local:        localStore{},
+	}
+)
+
+// TimesheetStore is the backend where the working hours of a user are
+// presented. The attendance ledger is the source of truth: a timesheet is
+// a projection of it and can be rewritten at any time.
+type TimesheetStore interface {
+	// Create initializes a new timesheet for the user and the given year.
+	// It returns an identifier to be saved in User.SheetId and, when the
+	// backend has one, an URL where the user can look at the timesheet.
+	Create(user *types.User, year int) (string, string, error)
+	// Load returns the records held by the timesheet for the month date
+	// belongs to.
+	Load(user *types.User, date time.Time) ([]types.Record, error)
+	// Sync rewrites the month date belongs to with records.
+	Sync(user *types.User, date time.Time, records []types.Record) error
+}
+
+func timesheetStore(user *types.User) (TimesheetStore, error) {
+	store, ok := timesheetStores[user.Backend]
+	if !ok {
+		return nil, errUnknownBackend
+	}
+	return store, nil
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+	maxUpdateSize     = 1 << 20
+)
+
+// WebhookConfig holds the configuration of the HTTP server receiving the
+// updates from Telegram.
+type WebhookConfig struct {
+	// URL is the public URL Telegram sends the updates to.
+	URL string
+	// Listen is the address the HTTP server listens on.
+	Listen string
+	// SecretToken is sent by Telegram along with every update.
+	SecretToken string
+	// TLSCert and TLSKey are the paths of the certificate and key used to
+	// serve HTTPS. Plain HTTP is served when empty, e.g. behind a reverse
+	// proxy terminating TLS.
+	TLSCert string
+	TLSKey  string
+}
+
+// HandleWebhookUpdates registers the webhook and handles the updates
+// received by it, using at most workers goroutines, until stop is closed.
+// Then it waits for the updates already received to be handled.
+func HandleWebhookUpdates(config WebhookConfig, workers int, stop <-chan struct{}) error {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return err
+	}
+
+	d := newDispatcher(workers)
+
+	mux := http.NewServeMux()
+	mux.Handle(urlPath(u), webhookHandler(d, config.SecretToken))
+	if oAuthCallback.RedirectURL != "" {
+		cu, err := url.Parse(oAuthCallback.RedirectURL)
+		if err != nil {
+			return err
+		}
+		if urlPath(cu) == urlPath(u) {
+			return errors.New("api: the OAuth callback and the webhook must have different paths")
+		}
+		mux.Handle(urlPath(cu), oAuthCallbackHandler(d))
+	}
+
+	srv := startHTTPServer(config.Listen, config.TLSCert, config.TLSKey, mux)
+
+	params := url.Values{}
+	params.Set("url", u.String())
+	if config.SecretToken != "" {
+		params.Set("secret_token", config.SecretToken)
+	}
+	_, err = telegramBot.MakeRequest("setWebhook", params)
+	if err != nil {
+		srv.srv.Close()
+		return err
+	}
+
+	logrus.Infof("Listening for updates on %s", config.Listen)
+
+	return runWorkers(d, stop, func() error {
+		return srv.serveUntil(stop)
+	})
+}
+
+// webhookHandler returns the handler dispatching the updates sent by
+// Telegram to the webhook.
+func webhookHandler(d *dispatcher, secretToken string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get(secretTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secretToken)) != 1 {
+			logrus.Warnf("Rejected webhook request from %s: invalid secret token", r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var u tgbotapi.Update
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpdateSize)).Decode(&u)
+		if err != nil {
+			logrus.Warnf("Could not decode webhook update: %s", err.Error())
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		d.dispatch(u)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// telegramTransport sends the requests for the Telegram Bot API to a
+// different server, e.g. a local fake for testing.
+type telegramTransport struct {
+	base *url.URL
+	next http.RoundTripper
+}
+
+func (t *telegramTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == "api.telegram.org" {
+		r = r.Clone(r.Context())
+		r.URL.Scheme = t.base.Scheme
+		r.URL.Host = t.base.Host
+		r.URL.Path = strings.TrimSuffix(t.base.Path, "/") + r.URL.Path
+		r.Host = t.base.Host
+	}
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBotAPI is a fake Telegram Bot API server recording the methods it is
+// called with.
+type fakeBotAPI struct {
+	mu      sync.Mutex
+	methods []string
+	chatIds []string
+	markups []string
+	texts   []string
+}
+
+func (f *fakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	f.mu.Lock()
+	f.methods = append(f.methods, method)
+	f.chatIds = append(f.chatIds, r.Form.Get("chat_id"))
+	f.markups = append(f.markups, r.Form.Get("reply_markup"))
+	f.texts = append(f.texts, r.Form.Get("text"))
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch method {
+	case "getMe":
+		w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"WorkBot","username":"workbot"}}`))
+	case "sendMessage", "editMessageText", "editMessageReplyMarkup":
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":` + r.Form.Get("chat_id") + `,"type":"private"}}}`))
+	default:
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	openTestDB(t)
+
+	api := &fakeBotAPI{}
+	apiSrv := httptest.NewServer(api)
+	defer apiSrv.Close()
+	err := NewTelegramBot("token", apiSrv.URL, false)
+	if err != nil {
+		t.Fatalf("could not start the bot: %s", err)
+	}
+
+	d := newDispatcher(1)
+	srv := httptest.NewServer(webhookHandler(d, "secret"))
+	defer srv.Close()
+
+	update := `{"update_id":1,"message":{"message_id":1,"date":0,"text":"/start","entities":[{"type":"bot_command","offset":0,"length":6}],"from":{"id":42,"first_name":"Mario","language_code":"it"},"chat":{"id":42,"type":"private"}}}`
+	// The updates rejected come from another user, who must get no reply
+	forged := strings.Replace(update, "42", "43", -1)
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+	}{
+		{"wrong method", http.MethodGet, "secret", "", http.StatusMethodNotAllowed},
+		{"missing secret", http.MethodPost, "", forged, http.StatusUnauthorized},
+		{"wrong secret", http.MethodPost, "wrong", forged, http.StatusUnauthorized},
+		{"malformed update", http.MethodPost, "secret", "{", http.StatusBadRequest},
+		{"update", http.MethodPost, "secret", update, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, srv.URL, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set(secretTokenHeader, tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+
+	// Only the accepted update is handled, replying to its sender
+	d.wait()
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	replies := 0
+	for i, m := range api.methods {
+		if m != "sendMessage" {
+			continue
+		}
+		replies++
+		if api.chatIds[i] != "42" {
+			t.Errorf("got a reply to %s, want 42", api.chatIds[i])
+		}
+	}
+	if replies == 0 {
+		t.Error("got no reply to the update")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lnovara/workbot/api"
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+)
+
+// command is a maintenance task run in place of the bot.
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+	// migrate tells whether the pending schema migrations are applied
+	// before running the command.
+	migrate bool
+}
+
+var commands = []command{
+	{"backfill-summaries", "Add or write again the summary sheets of the timesheets of a user, or of all users, carrying over the overtime balance", backfillSummaries, true},
+	{"migrate", "Show or change the schema version of the user database (status, up, down)", migrate, false},
+	{"rebuild-sheet", "Regenerate the timesheet of a user from the attendance ledger", rebuildSheet, true},
+	{"repair-sheet", "Find again the month sheets of a user after they were renamed, moved or deleted", repairSheet, true},
+	{"rewrite-sheets", "Write again the timesheets of a user, or of all users, with the current layout and formulas", rewriteSheets, true},
+	{"rotate-key", "Re-encrypt the Google OAuth tokens with a new encryption key", rotateKey, true},
+}
+
+func runCommand(name string, args []string) {
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+
+		err := openUserDB(c.migrate)
+		if err != nil {
+			logrus.Fatalf("Could not open user database %s: %s", dbFilePath, err.Error())
+		}
+
+		err = c.run(args)
+		if err != nil {
+			logrus.Fatalf("%s: %s", name, err.Error())
+		}
+		return
+	}
+
+	usageAndExit(fmt.Sprintf("Unknown command '%s'.", name), 1)
+}
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.Int("to", -1, "Schema version to migrate to (default: latest for up, previous for down)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s migrate [-to version] status|up|down\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	current, err := userdb.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	var migrations []userdb.Migration
+	switch fs.Arg(0) {
+	case "status":
+		status, err := userdb.MigrationsStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Schema version: %d (latest: %d)\n", current, userdb.LatestSchemaVersion())
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-40s  %s\n", s.Version, s.Description, applied)
+		}
+		return nil
+	case "up":
+		if *to < 0 {
+			*to = userdb.LatestSchemaVersion()
+		}
+		migrations, err = userdb.MigrateUp(*to)
+		for _, m := range migrations {
+			fmt.Printf("Applied migration %d: %s\n", m.Version, m.Description)
+		}
+	case "down":
+		if *to < 0 {
+			*to = current - 1
+		}
+		migrations, err = userdb.MigrateDown(*to)
+		for _, m := range migrations {
+			fmt.Printf("Reverted migration %d: %s\n", m.Version, m.Description)
+		}
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+	return err
+}
+
+func rebuildSheet(args []string) error {
+	fs := flag.NewFlagSet("rebuild-sheet", flag.ExitOnError)
+	userId := fs.Int("user", 0, "Telegram ID of the user whose timesheet has to be rebuilt")
+	fs.Parse(args)
+
+	if *userId == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	user, err := userdb.GetUser(*userId)
+	if err != nil {
+		return fmt.Errorf("could not get user '%d': %s", *userId, err.Error())
+	}
+
+	err = api.NewOAuthConfig(googleClientSecretFilePath, api.OAuthCallbackConfig{})
+	if err != nil {
+		return fmt.Errorf("could not initialize Google OAuth2 config: %s", err.Error())
+	}
+
+	sheetUrl, err := api.RebuildTimesheet(user)
+	if err != nil {
+		return err
+	}
+
+	if sheetUrl != "" {
+		fmt.Printf("Timesheet of user '%d' rebuilt: %s\n", user.Id, sheetUrl)
+	} else {
+		fmt.Printf("Timesheet of user '%d' rebuilt\n", user.Id)
+	}
+
+	return nil
+}
+
+func repairSheet(args []string) error {
+	fs := flag.NewFlagSet("repair-sheet", flag.ExitOnError)
+	userId := fs.Int("user", 0, "Telegram ID of the user whose timesheet has to be repaired")
+	fs.Parse(args)
+
+	if *userId == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	user, err := userdb.GetUser(*userId)
+	if err != nil {
+		return fmt.Errorf("could not get user '%d': %s", *userId, err.Error())
+	}
+
+	err = api.NewOAuthConfig(googleClientSecretFilePath, api.OAuthCallbackConfig{})
+	if err != nil {
+		return fmt.Errorf("could not initialize Google OAuth2 config: %s", err.Error())
+	}
+
+	err = api.RepairTimesheet(user)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Timesheet of user '%d' repaired\n", user.Id)
+	return nil
+}
+
+func rewriteSheets(args []string) error {
+	fs := flag.NewFlagSet("rewrite-sheets", flag.ExitOnError)
+	userId := fs.Int("user", 0, "Telegram ID of the user whose timesheets have to be rewritten (default: all users)")
+	fs.Parse(args)
+
+	ids := []int{*userId}
+	if *userId == 0 {
+		var err error
+		ids, err = userdb.GetUserIds()
+		if err != nil {
+			return fmt.Errorf("could not get users: %s", err.Error())
+		}
+	}
+
+	err := api.NewOAuthConfig(googleClientSecretFilePath, api.OAuthCallbackConfig{})
+	if err != nil {
+		return fmt.Errorf("could not initialize Google OAuth2 config: %s", err.Error())
+	}
+
+	failed := 0
+	for _, id := range ids {
+		user, err := userdb.GetUser(id)
+		if err != nil {
+			return fmt.Errorf("could not get user '%d': %s", id, err.Error())
+		}
+
+		err = api.RewriteTimesheet(user)
+		if err != nil {
+			logrus.Errorf("Could not rewrite the timesheets of user '%d': %s", id, err.Error())
+			failed++
+			continue
+		}
+		fmt.Printf("Timesheets of user '%d' rewritten\n", id)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("could not rewrite the timesheets of %d users", failed)
+	}
+	return nil
+}
+
+func backfillSummaries(args []string) error {
+	fs := flag.NewFlagSet("backfill-summaries", flag.ExitOnError)
+	userId := fs.Int("user", 0, "Telegram ID of the user whose summaries have to be written (default: all users)")
+	fs.Parse(args)
+
+	ids := []int{*userId}
+	if *userId == 0 {
+		var err error
+		ids, err = userdb.GetUserIds()
+		if err != nil {
+			return fmt.Errorf("could not get users: %s", err.Error())
+		}
+	}
+
+	err := api.NewOAuthConfig(googleClientSecretFilePath, api.OAuthCallbackConfig{})
+	if err != nil {
+		return fmt.Errorf("could not initialize Google OAuth2 config: %s", err.Error())
+	}
+
+	failed := 0
+	for _, id := range ids {
+		user, err := userdb.GetUser(id)
+		if err != nil {
+			return fmt.Errorf("could not get user '%d': %s", id, err.Error())
+		}
+
+		err = api.BackfillSummaries(user)
+		if err != nil {
+			logrus.Errorf("Could not write the summaries of user '%d': %s", id, err.Error())
+			failed++
+			continue
+		}
+		fmt.Printf("Summaries of user '%d' written\n", id)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("could not write the summaries of %d users", failed)
+	}
+	return nil
+}
+
+func rotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	newKeyValue := fs.String("new-key", os.Getenv("WORKBOT_NEW_ENCRYPTION_KEY"), "Base64 encoded new encryption key (or env var WORKBOT_NEW_ENCRYPTION_KEY)")
+	newKeyFile := fs.String("new-key-file", "", "Path to a file holding the base64 encoded new encryption key")
+	fs.Parse(args)
+
+	newKey, err := readKey(*newKeyValue, *newKeyFile)
+	if err != nil {
+		return fmt.Errorf("could not read new encryption key: %s", err.Error())
+	}
+	if newKey == nil {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	oldKey, err := readKey(encryptionKey, encryptionKeyFile)
+	if err != nil {
+		return fmt.Errorf("could not read encryption key: %s", err.Error())
+	}
+
+	n, err := userdb.RotateEncryptionKey(oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Re-encrypted %d Google OAuth tokens: restart WorkBot with the new encryption key\n", n)
+	return nil
+}
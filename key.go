@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lnovara/workbot/userdb"
+	"github.com/sirupsen/logrus"
+)
+
+// readKey returns the encryption key given either as value or in the file
+// at path, base64 encoded (e.g. generated with `openssl rand -base64 32`).
+// It returns nil if neither is given.
+func readKey(value string, path string) ([]byte, error) {
+	if value != "" && path != "" {
+		return nil, errors.New("give either the key or the key file, not both")
+	}
+
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = string(b)
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64 encoded: %s", err.Error())
+	}
+	if len(key) != userdb.EncryptionKeySize {
+		return nil, fmt.Errorf("key must be %d bytes long, got %d", userdb.EncryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+// openUserDB opens the user database, applying the pending schema
+// migrations if migrate is true, and encrypts the Google OAuth tokens
+// still stored in plain text if an encryption key was given.
+func openUserDB(migrate bool) error {
+	key, err := readKey(encryptionKey, encryptionKeyFile)
+	if err != nil {
+		return fmt.Errorf("could not read encryption key: %s", err.Error())
+	}
+
+	err = userdb.SetEncryptionKey(key)
+	if err != nil {
+		return err
+	}
+
+	if !migrate {
+		return userdb.OpenUserDB(dbFilePath)
+	}
+
+	if key == nil {
+		logrus.Warn("No encryption key given: Google OAuth tokens are stored in plain text")
+	}
+
+	applied, err := userdb.NewUserDB(dbFilePath)
+	for _, m := range applied {
+		logrus.Infof("Applied schema migration %d: %s", m.Version, m.Description)
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := userdb.EncryptPlainTextSecrets()
+	if n > 0 {
+		logrus.Infof("Encrypted %d Google OAuth tokens stored in plain text", n)
+	}
+	return err
+}
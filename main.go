@@ -4,9 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/lnovara/workbot/api"
-	"github.com/lnovara/workbot/userdb"
 	"github.com/lnovara/workbot/version"
 	"github.com/sirupsen/logrus"
 )
@@ -29,23 +30,49 @@ __      _____  _ __| | _| |__   ___ | |_
 
 var (
 	dbFilePath                 string
+	encryptionKey              string
+	encryptionKeyFile          string
 	googleAPIKey               string
 	googleClientSecretFilePath string
+	telegramAPIURL             string
 	telegramToken              string
+	mode                       string
+	oAuthCallback              api.OAuthCallbackConfig
+	webhook                    api.WebhookConfig
+	workers                    int
 
 	debug bool
 )
 
 func init() {
 	flag.StringVar(&dbFilePath, "db", "./workbot-users.sqlite3", "User database path")
+	flag.StringVar(&encryptionKey, "encryption-key", os.Getenv("WORKBOT_ENCRYPTION_KEY"), "Base64 encoded key encrypting the Google OAuth tokens at rest (or env var WORKBOT_ENCRYPTION_KEY)")
+	flag.StringVar(&encryptionKeyFile, "encryption-key-file", "", "Path to a file holding the base64 encoded encryption key")
 	flag.StringVar(&googleAPIKey, "google-api-key", os.Getenv("GOOGLE_API_KEY"), "Google API key (or env var GOOGLE_API_KEY)")
 	flag.StringVar(&googleClientSecretFilePath, "google-client-secrets", "./client_secrets.json", "Path to Google's client_secret.json file")
 	flag.StringVar(&telegramToken, "telegram-token", os.Getenv("TELEGRAM_TOKEN"), "Telegram API token (or env var TELEGRAM_TOKEN)")
 
+	flag.StringVar(&telegramAPIURL, "telegram-api-url", "", "Base URL of the Telegram Bot API (default https://api.telegram.org)")
+	flag.StringVar(&mode, "mode", "polling", "How to receive updates from Telegram: polling or webhook")
+	flag.StringVar(&webhook.URL, "webhook-url", os.Getenv("WEBHOOK_URL"), "Public URL of the webhook (or env var WEBHOOK_URL)")
+	flag.StringVar(&webhook.Listen, "webhook-listen", ":8443", "Address the webhook HTTP server listens on")
+	flag.StringVar(&webhook.SecretToken, "webhook-secret", os.Getenv("WEBHOOK_SECRET"), "Secret token Telegram sends with every update (or env var WEBHOOK_SECRET)")
+	flag.StringVar(&webhook.TLSCert, "webhook-tls-cert", "", "Path to the webhook TLS certificate (serve plain HTTP if empty)")
+	flag.StringVar(&webhook.TLSKey, "webhook-tls-key", "", "Path to the webhook TLS key")
+	flag.StringVar(&oAuthCallback.RedirectURL, "oauth-redirect-url", os.Getenv("OAUTH_REDIRECT_URL"), "Public URL Google redirects the users to after the authorization (or env var OAUTH_REDIRECT_URL); users send the authorization code in the chat if empty")
+	flag.StringVar(&oAuthCallback.Listen, "oauth-listen", ":8080", "Address the OAuth callback HTTP server listens on in polling mode (the webhook server is used in webhook mode)")
+	flag.DurationVar(&api.UndoWindow, "undo-window", api.UndoWindow, "How long after being recorded a punch can be undone")
+	flag.IntVar(&workers, "workers", 8, "Maximum number of updates handled concurrently")
+
 	flag.BoolVar(&debug, "d", false, "run in debug mode")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, fmt.Sprintf(BANNER, version.VERSION, version.GITCOMMIT))
+		fmt.Fprintf(os.Stderr, BANNER, version.VERSION, version.GITCOMMIT)
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+		for _, c := range commands {
+			fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.description)
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
 		flag.PrintDefaults()
 	}
 
@@ -54,6 +81,13 @@ func init() {
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
+}
+
+func main() {
+	if flag.NArg() > 0 {
+		runCommand(flag.Arg(0), flag.Args()[1:])
+		return
+	}
 
 	if googleAPIKey == "" {
 		usageAndExit("Google API key cannot be empty.", 1)
@@ -62,21 +96,35 @@ func init() {
 	if telegramToken == "" {
 		usageAndExit("Telegram API key cannot be empty.", 1)
 	}
-}
 
-func main() {
+	if mode != "polling" && mode != "webhook" {
+		usageAndExit(fmt.Sprintf("Unknown mode '%s'.", mode), 1)
+	}
+
+	if mode == "webhook" {
+		if webhook.URL == "" {
+			usageAndExit("Webhook URL cannot be empty in webhook mode.", 1)
+		}
+		if webhook.SecretToken == "" {
+			usageAndExit("Webhook secret token cannot be empty in webhook mode.", 1)
+		}
+		if (webhook.TLSCert == "") != (webhook.TLSKey == "") {
+			usageAndExit("Both webhook TLS certificate and key must be given.", 1)
+		}
+	}
+
 	var err error
 
 	logrus.Info("Welcome to WorkBot!!!")
 
-	api.NewTelegramBot(telegramToken, debug)
+	err = api.NewTelegramBot(telegramToken, telegramAPIURL, debug)
 	if err != nil {
 		logrus.Fatalf("Could not initialize Telegram Bot API: %s", err.Error())
 	}
 
 	logrus.Debug("Telegram Bot API initialization done")
 
-	err = userdb.NewUserDB(dbFilePath)
+	err = openUserDB(true)
 	if err != nil {
 		logrus.Fatalf("Could not create user database %s: %s", dbFilePath, err.Error())
 	}
@@ -90,19 +138,37 @@ func main() {
 
 	logrus.Debug("Google Maps client initialization done")
 
-	api.NewOAuthConfig(googleClientSecretFilePath)
+	err = api.NewOAuthConfig(googleClientSecretFilePath, oAuthCallback)
 	if err != nil {
 		logrus.Fatalf("Could not initialize Google OAuth2 config: %s", err.Error())
 	}
 
 	logrus.Debug("OAuth config initialization done")
 
-	api.HandleBotUpdates()
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Infof("Received %s, shutting down...", sig)
+		close(stop)
+	}()
+
+	if mode == "webhook" {
+		err = api.HandleWebhookUpdates(webhook, workers, stop)
+	} else {
+		err = api.HandleBotUpdates(workers, stop)
+	}
+	if err != nil {
+		logrus.Fatalf("Could not handle bot updates: %s", err.Error())
+	}
+
+	logrus.Info("Bye!")
 }
 
 func usageAndExit(message string, exitCode int) {
 	if message != "" {
-		fmt.Fprintf(os.Stderr, message)
+		fmt.Fprint(os.Stderr, message)
 		fmt.Fprintf(os.Stderr, "\n\n")
 	}
 
@@ -0,0 +1,50 @@
+package types
+
+import "time"
+
+// EventKind identifies what an attendance event records.
+type EventKind uint
+
+// Enumeration of possible event kinds.
+const (
+	EnterEvent = EventKind(iota)
+	ExitEvent
+	// VoidEvent reverts the event it replaces, e.g. a punch made by
+	// mistake.
+	VoidEvent
+)
+
+// WorkBot is the RecordedBy of the events recorded by WorkBot itself, e.g.
+// the exits closing the forgotten intervals.
+const WorkBot = 0
+
+// Imported is the RecordedBy of the events imported from the timesheet of
+// the user, registered before the ledger existed.
+const Imported = -1
+
+// Event is an entry of the append-only attendance ledger. An event is
+// corrected by appending a new one replacing it.
+type Event struct {
+	Id         int64     `db:"id"`
+	UserId     int       `db:"user_id"`
+	Kind       EventKind `db:"kind"`
+	Time       time.Time `db:"time"`
+	RecordedAt time.Time `db:"recorded_at"`
+	// RecordedBy is the ID of the user who recorded the event, WorkBot or
+	// Imported.
+	RecordedBy int `db:"recorded_by"`
+	// Replaces is the ID of the event corrected by this one, if any.
+	Replaces int64 `db:"replaces"`
+}
+
+// NewEvent creates a new event of the given kind happened at t, recorded
+// by the user themselves.
+func NewEvent(userId int, kind EventKind, t time.Time) *Event {
+	return &Event{
+		UserId:     userId,
+		Kind:       kind,
+		Time:       t.UTC(),
+		RecordedAt: time.Now().UTC(),
+		RecordedBy: userId,
+	}
+}
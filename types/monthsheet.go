@@ -0,0 +1,13 @@
+package types
+
+// MonthSheet is the sheet of a month in the spreadsheet of a user. Sheets
+// are addressed by their ID, which does not change when they are renamed or
+// moved.
+type MonthSheet struct {
+	UserId        int    `db:"user_id"`
+	SpreadsheetId string `db:"spreadsheet_id"`
+	// Month is the number of the month, from 1 for January, or 0 for the
+	// summary sheet.
+	Month   int   `db:"month"`
+	SheetId int64 `db:"sheet_id"`
+}
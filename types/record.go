@@ -0,0 +1,95 @@
+package types
+
+import "time"
+
+// Interval is a period of work between a clock-in and a clock-out.
+type Interval struct {
+	Enter time.Time
+	Exit  time.Time
+	// AutoExit tells whether the exit was recorded by WorkBot, closing a
+	// forgotten interval.
+	AutoExit bool
+}
+
+// HasExit reports whether the exit time has been registered.
+func (i *Interval) HasExit() bool {
+	return !i.Exit.IsZero()
+}
+
+// Record holds the working hours registered by a user on a single day, as
+// intervals in chronological order.
+type Record struct {
+	Date      string
+	Intervals []Interval
+}
+
+// Enter returns the time of the first entry of the day.
+func (r *Record) Enter() time.Time {
+	if len(r.Intervals) == 0 {
+		return time.Time{}
+	}
+	return r.Intervals[0].Enter
+}
+
+// Exit returns the time of the last exit of the day, or the zero time if
+// the user is still at work.
+func (r *Record) Exit() time.Time {
+	if len(r.Intervals) == 0 {
+		return time.Time{}
+	}
+	return r.Intervals[len(r.Intervals)-1].Exit
+}
+
+// HasExit reports whether the last interval of the day has been closed.
+func (r *Record) HasExit() bool {
+	return !r.Exit().IsZero()
+}
+
+// Worked returns the time worked in the closed intervals.
+func (r *Record) Worked() time.Duration {
+	var worked time.Duration
+	for _, i := range r.Intervals {
+		if i.HasExit() {
+			worked += i.Exit.Sub(i.Enter)
+		}
+	}
+	return worked
+}
+
+// WorkedAt returns the time worked until now, including the open interval.
+func (r *Record) WorkedAt(now time.Time) time.Duration {
+	worked := r.Worked()
+	if len(r.Intervals) > 0 && !r.HasExit() {
+		if enter := r.Intervals[len(r.Intervals)-1].Enter; now.After(enter) {
+			worked += now.Sub(enter)
+		}
+	}
+	return worked
+}
+
+// AutoExit reports whether WorkBot closed any interval of the day.
+func (r *Record) AutoExit() bool {
+	for _, i := range r.Intervals {
+		if i.AutoExit {
+			return true
+		}
+	}
+	return false
+}
+
+// Break returns the time elapsed between the intervals.
+func (r *Record) Break() time.Duration {
+	var pause time.Duration
+	for i := 1; i < len(r.Intervals); i++ {
+		if r.Intervals[i-1].HasExit() {
+			pause += r.Intervals[i].Enter.Sub(r.Intervals[i-1].Exit)
+		}
+	}
+	return pause
+}
+
+// TheoreticalExit returns when the user should exit to work for workDay,
+// given the breaks taken so far.
+func (r *Record) TheoreticalExit(workDay time.Duration) time.Time {
+	return r.Enter().Add(workDay + r.Break())
+}
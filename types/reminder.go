@@ -0,0 +1,12 @@
+package types
+
+import "time"
+
+// Reminder records that a user has been reminded of something, e.g. to
+// clock out on a given day, and whether they asked to be reminded again.
+type Reminder struct {
+	UserId       int       `db:"user_id"`
+	Name         string    `db:"name"`
+	SentAt       time.Time `db:"sent_at"`
+	SnoozedUntil time.Time `db:"snoozed_until"`
+}
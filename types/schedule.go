@@ -0,0 +1,88 @@
+package types
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule overrides the length of the work day on some weekdays, e.g.
+// short Fridays or part-time days. A length of zero is a day off.
+type Schedule map[time.Weekday]time.Duration
+
+// WorkSchedule holds the work day settings of a user in effect from a day
+// on, so that the days already worked keep the settings they were worked
+// with.
+type WorkSchedule struct {
+	UserId int `db:"user_id"`
+	// EffectiveFrom is the first day the settings apply to, as
+	// "2006-01-02".
+	EffectiveFrom  string    `db:"effective_from"`
+	WorkDay        time.Time `db:"work_day"`
+	ExtraWorkStart time.Time `db:"extra_work_start"`
+	Schedule       Schedule  `db:"schedule"`
+}
+
+// WorkDuration returns the length of the work day on the weekday of date,
+// as given by the schedule or else by WorkDay.
+func (s *WorkSchedule) WorkDuration(date time.Time) time.Duration {
+	if d, ok := s.Schedule[date.Weekday()]; ok {
+		return d
+	}
+	h, m, sec := s.WorkDay.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+}
+
+// Value stores the schedule as "weekday=minutes" pairs, e.g. "5=360".
+func (s Schedule) Value() (driver.Value, error) {
+	var days []int
+	for day := range s {
+		days = append(days, int(day))
+	}
+	sort.Ints(days)
+
+	var pairs []string
+	for _, day := range days {
+		pairs = append(pairs, fmt.Sprintf("%d=%d", day, s[time.Weekday(day)]/time.Minute))
+	}
+	return strings.Join(pairs, ","), nil
+}
+
+// Scan reads the schedule stored by Value.
+func (s *Schedule) Scan(src interface{}) error {
+	var value string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("types: cannot scan %T into a schedule", src)
+	}
+
+	schedule := Schedule{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("types: invalid schedule %q", value)
+		}
+		day, err := strconv.Atoi(fields[0])
+		if err != nil || day < 0 || day > 6 {
+			return fmt.Errorf("types: invalid schedule %q", value)
+		}
+		minutes, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("types: invalid schedule %q", value)
+		}
+		schedule[time.Weekday(day)] = time.Duration(minutes) * time.Minute
+	}
+	*s = schedule
+	return nil
+}
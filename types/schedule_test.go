@@ -0,0 +1,61 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduleValue(t *testing.T) {
+	tests := []struct {
+		schedule Schedule
+		want     string
+	}{
+		{nil, ""},
+		{Schedule{}, ""},
+		{Schedule{time.Friday: 6 * time.Hour}, "5=360"},
+		{Schedule{time.Saturday: 0, time.Monday: 4*time.Hour + 30*time.Minute}, "1=270,6=0"},
+	}
+	for _, tt := range tests {
+		got, err := tt.schedule.Value()
+		if err != nil || got != tt.want {
+			t.Errorf("%v: got %v, %v, want %q", tt.schedule, got, err, tt.want)
+		}
+	}
+}
+
+func TestScheduleScan(t *testing.T) {
+	tests := []struct {
+		src     interface{}
+		want    Schedule
+		invalid bool
+	}{
+		{nil, Schedule{}, false},
+		{"", Schedule{}, false},
+		{"5=360", Schedule{time.Friday: 6 * time.Hour}, false},
+		{[]byte("1=270,6=0"), Schedule{time.Monday: 4*time.Hour + 30*time.Minute, time.Saturday: 0}, false},
+		{"7=60", nil, true},
+		{"1", nil, true},
+		{"1=x", nil, true},
+		{42, nil, true},
+	}
+	for _, tt := range tests {
+		var got Schedule
+		err := got.Scan(tt.src)
+		if (err != nil) != tt.invalid {
+			t.Errorf("%v: got error %v", tt.src, err)
+			continue
+		}
+		if !tt.invalid && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.src, got, tt.want)
+		}
+	}
+
+	// Scan reads back what Value stores
+	schedule := Schedule{time.Wednesday: 3 * time.Hour, time.Sunday: 0}
+	value, _ := schedule.Value()
+	var got Schedule
+	if err := got.Scan(value); err != nil || !reflect.DeepEqual(got, schedule) {
+		t.Errorf("round trip: got %v, %v, want %v", got, err, schedule)
+	}
+}
@@ -14,4 +14,16 @@ const (
 	UserSetupAccessTime
 	UserSetupClientSecret
 	UserSetupTimezone
+	UserSetupBackend
+	Punch
+	Undo
+	Status
+	Report
+	SetDigest
+	SetClosePolicy
+	SetWorkDay
+	SetExtraWorkStart
+	SetSchedule
+	SetLanguage
+	SetHolidays
 )
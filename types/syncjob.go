@@ -0,0 +1,15 @@
+package types
+
+import "time"
+
+// SyncJob is a pending write of a month of the attendance ledger to the
+// timesheet of a user.
+type SyncJob struct {
+	Id          int64     `db:"id"`
+	UserId      int       `db:"user_id"`
+	Month       string    `db:"month"`
+	Attempts    int       `db:"attempts"`
+	NextAttempt time.Time `db:"next_attempt"`
+	LastError   string    `db:"last_error"`
+	CreatedAt   time.Time `db:"created_at"`
+}
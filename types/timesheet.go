@@ -0,0 +1,11 @@
+package types
+
+// Timesheet is the spreadsheet holding the working hours of a user in a
+// year. A new one is created every year, while the older ones are kept.
+type Timesheet struct {
+	UserId  int    `db:"user_id"`
+	Year    int    `db:"year"`
+	SheetId string `db:"sheet_id"`
+	// SheetUrl is where the user can look at the timesheet.
+	SheetUrl string `db:"sheet_url"`
+}
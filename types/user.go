@@ -11,6 +11,58 @@ var (
 	defaultExtraWorkStart = time.Date(2000, 1, 1, 0, 19, 59, 0, time.UTC)
 )
 
+// Backend identifies where the working hours of a user are recorded.
+type Backend string
+
+// Available timesheet backends.
+const (
+	GoogleSheets = Backend("sheets")
+	Local        = Backend("local")
+)
+
+// Digest is how often a user receives a summary of their working hours.
+type Digest string
+
+// Available digests.
+const (
+	NoDigest      = Digest("")
+	WeeklyDigest  = Digest("week")
+	MonthlyDigest = Digest("month")
+)
+
+// ClosePolicy is what happens to a day whose exit has been forgotten.
+type ClosePolicy string
+
+// Available close policies.
+const (
+	// LeaveOpen leaves the day open, flagging it.
+	LeaveOpen = ClosePolicy("open")
+	// CloseAtTheoreticalExit closes the day at the theoretical exit.
+	CloseAtTheoreticalExit = ClosePolicy("theoretical")
+	// CloseAtFixedTime closes the day at User.CloseTime.
+	CloseAtFixedTime = ClosePolicy("fixed")
+)
+
+// Holidays is the calendar of the public holidays of a user, on which they
+// are not reminded to clock in and out.
+type Holidays string
+
+// Available holiday calendars.
+const (
+	NoHolidays      = Holidays("")
+	ItalianHolidays = Holidays("it")
+)
+
+// Language is the language a user talks to the bot in, as an ISO 639-1
+// code.
+type Language string
+
+// Available languages.
+const (
+	Italian = Language("it")
+	English = Language("en")
+)
+
 // User holds the information needed to identify each user
 type User struct {
 	Id             int            `db:"id"`
@@ -23,6 +75,16 @@ type User struct {
 	ClientSecret   types.JSONText `db:"client_secret"`
 	State          State          `db:"state"`
 	TimeZone       string         `db:"time_zone"`
+	Backend        Backend        `db:"backend"`
+	LedgerStart    time.Time      `db:"ledger_start"`
+	Digest         Digest         `db:"digest"`
+	ClosePolicy    ClosePolicy    `db:"close_policy"`
+	CloseTime      time.Time      `db:"close_time"`
+	Schedule       Schedule       `db:"schedule"`
+	Language       Language       `db:"language"`
+	// SheetLanguage is the language the timesheet was created in.
+	SheetLanguage Language `db:"sheet_language"`
+	Holidays      Holidays `db:"holidays"`
 }
 
 // NewUser creates a new user with sensible defaults
@@ -31,5 +93,25 @@ func NewUser() *User {
 		WorkDay:        defaultWorkDay,
 		ExtraWorkStart: defaultExtraWorkStart,
 		State:          Main,
+		ClosePolicy:    LeaveOpen,
+		Language:       Italian,
+		SheetLanguage:  Italian,
+		Holidays:       ItalianHolidays,
 	}
 }
+
+// WorkSchedule returns the current work day settings of the user.
+func (u *User) WorkSchedule() *WorkSchedule {
+	return &WorkSchedule{
+		UserId:         u.Id,
+		WorkDay:        u.WorkDay,
+		ExtraWorkStart: u.ExtraWorkStart,
+		Schedule:       u.Schedule,
+	}
+}
+
+// WorkDuration returns the length of the work day of the user on the
+// weekday of date, as given by their current schedule or else by WorkDay.
+func (u *User) WorkDuration(date time.Time) time.Duration {
+	return u.WorkSchedule().WorkDuration(date)
+}
@@ -0,0 +1,205 @@
+package userdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// EncryptionKeySize is the size in bytes of the key used to encrypt the
+	// client secrets (AES-256).
+	EncryptionKeySize = 32
+
+	sealedSecretVersion = 1
+)
+
+var (
+	errInvalidKeySize   = fmt.Errorf("userdb: encryption key must be %d bytes long", EncryptionKeySize)
+	errNoEncryptionKey  = errors.New("userdb: client secret is encrypted but no encryption key was given")
+	errWrongKey         = errors.New("userdb: client secret is encrypted with a different key")
+	errUnknownSealedVer = errors.New("userdb: unknown encrypted client secret version")
+
+	encryptionKey []byte
+)
+
+// sealedSecret is the representation of an encrypted client secret in the
+// database. It is stored as JSON too, so that it can live in the same
+// column as the plain text secrets.
+type sealedSecret struct {
+	Version int    `json:"v"`
+	KeyId   string `json:"kid"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// SetEncryptionKey sets the key used to encrypt the client secrets at rest.
+// A nil key leaves them in plain text.
+func SetEncryptionKey(key []byte) error {
+	if key != nil && len(key) != EncryptionKeySize {
+		return errInvalidKeySize
+	}
+	encryptionKey = key
+	return nil
+}
+
+// keyId identifies a key without revealing it.
+func keyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds an encrypted secret to its user, so that it cannot
+// be copied to another row.
+func additionalData(userId int) []byte {
+	return []byte(fmt.Sprintf("workbot:user:%d", userId))
+}
+
+// sealSecret encrypts the client secret of a user with key.
+func sealSecret(key []byte, userId int, secret []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&sealedSecret{
+		Version: sealedSecretVersion,
+		KeyId:   keyId(key),
+		Nonce:   nonce,
+		Data:    gcm.Seal(nil, nonce, secret, additionalData(userId)),
+	})
+}
+
+// parseSealedSecret returns the encrypted secret held by stored, or nil if
+// stored is a plain text secret.
+func parseSealedSecret(stored []byte) *sealedSecret {
+	var s sealedSecret
+	if json.Unmarshal(stored, &s) != nil || s.Version == 0 || s.Data == nil {
+		return nil
+	}
+	return &s
+}
+
+// openSecret decrypts the client secret of a user with key. Plain text
+// secrets are returned as they are.
+func openSecret(key []byte, userId int, stored []byte) ([]byte, error) {
+	s := parseSealedSecret(stored)
+	if s == nil {
+		return stored, nil
+	}
+	if s.Version != sealedSecretVersion {
+		return nil, errUnknownSealedVer
+	}
+	if key == nil {
+		return nil, errNoEncryptionKey
+	}
+	if s.KeyId != keyId(key) {
+		return nil, errWrongKey
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, s.Nonce, s.Data, additionalData(userId))
+}
+
+// RotateEncryptionKey re-encrypts all the client secrets, currently
+// encrypted with oldKey or in plain text, with newKey. It returns the
+// number of secrets re-encrypted.
+func RotateEncryptionKey(oldKey []byte, newKey []byte) (int, error) {
+	if (oldKey != nil && len(oldKey) != EncryptionKeySize) || len(newKey) != EncryptionKeySize {
+		return 0, errInvalidKeySize
+	}
+
+	rows, err := selectSecrets()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := dbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, r := range rows {
+		secret, err := openSecret(oldKey, r.Id, r.ClientSecret)
+		if err == nil {
+			secret, err = sealSecret(newKey, r.Id, secret)
+		}
+		if err == nil {
+			_, err = tx.Exec("update users set client_secret = ? where id = ?", secret, r.Id)
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("user '%d': %s", r.Id, err.Error())
+		}
+		count++
+	}
+
+	return count, tx.Commit()
+}
+
+// EncryptPlainTextSecrets encrypts with the current key the client secrets
+// stored in plain text. It returns the number of secrets encrypted.
+func EncryptPlainTextSecrets() (int, error) {
+	if encryptionKey == nil {
+		return 0, nil
+	}
+
+	rows, err := selectSecrets()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, r := range rows {
+		if parseSealedSecret(r.ClientSecret) != nil {
+			continue
+		}
+		secret, err := sealSecret(encryptionKey, r.Id, r.ClientSecret)
+		if err != nil {
+			return count, err
+		}
+		_, err = dbMap.Exec("update users set client_secret = ? where id = ?", secret, r.Id)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+type secretRow struct {
+	Id           int    `db:"id"`
+	ClientSecret []byte `db:"client_secret"`
+}
+
+// selectSecrets retrieves the client secrets of the users who have one.
+func selectSecrets() ([]secretRow, error) {
+	var rows []secretRow
+	err := dbMap.Dbx.Select(&rows, "select id, client_secret from users where client_secret is not null and client_secret not in ('', '{}')")
+	return rows, err
+}
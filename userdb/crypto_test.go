@@ -0,0 +1,58 @@
+package userdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestSealSecret(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, EncryptionKeySize)
+	otherKey := bytes.Repeat([]byte{2}, EncryptionKeySize)
+	secret := []byte(`{"access_token":"token"}`)
+
+	sealed, err := sealSecret(key, 42, secret)
+	if err != nil {
+		t.Fatalf("could not seal the secret: %s", err)
+	}
+	if bytes.Contains(sealed, []byte("token")) {
+		t.Error("the sealed secret holds the plain text")
+	}
+	again, _ := sealSecret(key, 42, secret)
+	if bytes.Equal(sealed, again) {
+		t.Error("the same secret was sealed twice with the same nonce")
+	}
+
+	unknown := parseSealedSecret(sealed)
+	unknown.Version = sealedSecretVersion + 1
+	unknownVer, _ := json.Marshal(unknown)
+
+	tests := []struct {
+		name    string
+		key     []byte
+		userId  int
+		stored  []byte
+		want    []byte
+		invalid bool
+		err     error
+	}{
+		{"sealed", key, 42, sealed, secret, false, nil},
+		{"plain text", key, 42, secret, secret, false, nil},
+		{"plain text without key", nil, 42, secret, secret, false, nil},
+		{"without key", nil, 42, sealed, nil, true, errNoEncryptionKey},
+		{"wrong key", otherKey, 42, sealed, nil, true, errWrongKey},
+		{"unknown version", key, 42, unknownVer, nil, true, errUnknownSealedVer},
+		// The secret cannot be copied to another user
+		{"other user", key, 43, sealed, nil, true, nil},
+	}
+	for _, tt := range tests {
+		got, err := openSecret(tt.key, tt.userId, tt.stored)
+		if (err != nil) != tt.invalid || tt.err != nil && err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package userdb
+
+import (
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+// GetDigestUserIds retrieves the IDs of the users who receive a digest
+func GetDigestUserIds() ([]int, error) {
+	var ids []int
+	err := dbMap.Dbx.Select(&ids, "select id from users where digest != ? order by id", types.NoDigest)
+	return ids, err
+}
+
+// IsDigestSent tells whether the digest of the given period has been sent
+// to a user
+func IsDigestSent(userId int, period string) (bool, error) {
+	var count int
+	err := dbMap.Dbx.Get(&count, "select count(*) from digests where user_id = ? and period = ?", userId, period)
+	return count > 0, err
+}
+
+// MarkDigestSent records that the digest of the given period has been sent
+// to a user
+func MarkDigestSent(userId int, period string) error {
+	_, err := dbMap.Exec("insert or ignore into digests (user_id, period, sent_at) values (?, ?, ?)", userId, period, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,69 @@
+package userdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+// replacedEvents matches the events replaced by a correction, which are
+// kept in the ledger for auditing only.
+const replacedEvents = "id in (select replaces from ledger where replaces != 0)"
+
+// activeEvents matches the events that make up the working hours: neither
+// replaced nor reverting other events.
+var activeEvents = fmt.Sprintf("not %s and kind != %d", replacedEvents, types.VoidEvent)
+
+// AppendEvent appends a new event to the attendance ledger
+func AppendEvent(event *types.Event) error {
+	err := dbMap.Insert(event)
+	return err
+}
+
+// GetEvents retrieves the events of a user happened in [from, to)
+func GetEvents(userId int, from time.Time, to time.Time) ([]types.Event, error) {
+	var events []types.Event
+	err := dbMap.Select(&events, "select * from ledger where user_id = ? and time >= ? and time < ? and "+activeEvents+" order by time, id",
+		userId, from.UTC(), to.UTC())
+	return events, err
+}
+
+// CountEvents counts the events of a user happened in [from, to)
+func CountEvents(userId int, from time.Time, to time.Time) (int, error) {
+	var count int
+	err := dbMap.Dbx.Get(&count, "select count(*) from ledger where user_id = ? and time >= ? and time < ? and "+activeEvents,
+		userId, from.UTC(), to.UTC())
+	return count, err
+}
+
+// GetLastEvent retrieves the last event of a user happened not after t
+func GetLastEvent(userId int, t time.Time) (*types.Event, error) {
+	event := &types.Event{}
+	err := dbMap.Dbx.Get(event, "select * from ledger where user_id = ? and time <= ? and "+activeEvents+" order by time desc, id desc limit 1",
+		userId, t.UTC())
+	return event, err
+}
+
+// GetNextEvent retrieves the first event of a user happened after t
+func GetNextEvent(userId int, t time.Time) (*types.Event, error) {
+	event := &types.Event{}
+	err := dbMap.Dbx.Get(event, "select * from ledger where user_id = ? and time > ? and "+activeEvents+" order by time, id limit 1",
+		userId, t.UTC())
+	return event, err
+}
+
+// GetEvent retrieves an event of the ledger
+func GetEvent(id int64) (*types.Event, error) {
+	event := &types.Event{}
+	err := dbMap.Get(event, id)
+	return event, err
+}
+
+// GetLastRecordedEvent retrieves the last event recorded for a user
+func GetLastRecordedEvent(userId int) (*types.Event, error) {
+	event := &types.Event{}
+	err := dbMap.Dbx.Get(event, "select * from ledger where user_id = ? and "+activeEvents+" order by id desc limit 1",
+		userId)
+	return event, err
+}
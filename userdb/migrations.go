@@ -0,0 +1,575 @@
+package userdb
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lnovara/workbot/types"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Migration is a numbered change of the schema of the user database.
+type Migration struct {
+	Version     int
+	Description string
+	up          func(tx *sqlx.Tx) error
+	down        func(tx *sqlx.Tx) error
+}
+
+// MigrationStatus tells whether a migration has been applied to the user
+// database, and when.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Tables as created by the migrations. Their definitions must match the
+// columns mapped by modl.
+const (
+	usersTableV1 = `create table if not exists users ("id" integer not null primary key, "first_name" text, "access_start_time" datetime, "access_end_time" datetime, "work_day" datetime, "extra_work_start" datetime, "sheet_id" text, "client_secret" blob, "state" text, "time_zone" text)`
+	usersTableV2 = `create table if not exists users ("id" integer not null primary key, "first_name" text, "access_start_time" datetime, "access_end_time" datetime, "work_day" datetime, "extra_work_start" datetime, "sheet_id" text, "client_secret" blob, "state" text, "time_zone" text, "backend" text not null default 'sheets')`
+	usersTableV3 = `create table if not exists users ("id" integer not null primary key, "first_name" text, "access_start_time" datetime, "access_end_time" datetime, "work_day" datetime, "extra_work_start" datetime, "sheet_id" text, "client_secret" blob, "state" text, "time_zone" text, "backend" text not null default 'sheets', "ledger_start" datetime not null default '0001-01-01 00:00:00+00:00')`
+	usersTableV4 = `create table if not exists users ("id" integer not null primary key, "first_name" text, "access_start_time" datetime, "access_end_time" datetime, "work_day" datetime, "extra_work_start" datetime, "sheet_id" text, "client_secret" blob, "state" text, "time_zone" text, "backend" text not null default 'sheets', "ledger_start" datetime not null default '0001-01-01 00:00:00+00:00', "digest" text not null default '')`
+	usersTableV5 = `create table if not exists users ("id" integer not null primary key, "first_name" text, "access_start_time" datetime, "access_end_time" datetime, "work_day" datetime, "extra_work_start" datetime, "sheet_id" text, "client_secret" blob, "state" text, "time_zone" text, "backend" text not null default 'sheets', "ledger_start" datetime not null default '0001-01-01 00:00:00+00:00', "digest" text not null default '', "close_policy" text not null default 'open', "close_time" datetime not null default '0001-01-01 00:00:00+00:00')`
+	usersTableV6 = `create table if not exists users ("id" integer not null primary key, "first_name" text, "access_start_time" datetime, "access_end_time" datetime, "work_day" datetime, "extra_work_start" datetime, "sheet_id" text, "client_secret" blob, "state" text, "time_zone" text, "backend" text not null default 'sheets', "ledger_start" datetime not null default '0001-01-01 00:00:00+00:00', "digest" text not null default '', "close_policy" text not null default 'open', "close_time" datetime not null default '0001-01-01 00:00:00+00:00', "schedule" text not null default '')`
+	usersTableV7 = `create table if not exists users ("id" integer not null primary key, "first_name" text, "access_start_time" datetime, "access_end_time" datetime, "work_day" datetime, "extra_work_start" datetime, "sheet_id" text, "client_secret" blob, "state" text, "time_zone" text, "backend" text not null default 'sheets', "ledger_start" datetime not null default '0001-01-01 00:00:00+00:00', "digest" text not null default '', "close_policy" text not null default 'open', "close_time" datetime not null default '0001-01-01 00:00:00+00:00', "schedule" text not null default '', "language" text not null default 'it', "sheet_language" text not null default 'it')`
+
+	usersColumnsV1 = `id, first_name, access_start_time, access_end_time, work_day, extra_work_start, sheet_id, client_secret, state, time_zone`
+	usersColumnsV2 = usersColumnsV1 + `, backend`
+	usersColumnsV3 = usersColumnsV2 + `, ledger_start`
+	usersColumnsV4 = usersColumnsV3 + `, digest`
+	usersColumnsV5 = usersColumnsV4 + `, close_policy, close_time`
+	usersColumnsV6 = usersColumnsV5 + `, schedule`
+	usersColumnsV7 = usersColumnsV6 + `, language, sheet_language`
+
+	recordsTable     = `create table if not exists records ("id" integer not null primary key autoincrement, "user_id" integer, "date" text, "enter_time" datetime, "exit_time" datetime)`
+	ledgerTable      = `create table if not exists ledger ("id" integer not null primary key autoincrement, "user_id" integer, "kind" text, "time" datetime, "recorded_at" datetime)`
+	outboxTable      = `create table if not exists outbox ("id" integer not null primary key autoincrement, "user_id" integer, "month" text, "attempts" integer, "next_attempt" datetime, "last_error" text, "created_at" datetime)`
+	digestsTable     = `create table if not exists digests ("user_id" integer not null, "period" text not null, "sent_at" datetime, primary key ("user_id", "period"))`
+	remindersTable   = `create table if not exists reminders ("user_id" integer not null, "name" text not null, "sent_at" datetime, "snoozed_until" datetime, primary key ("user_id", "name"))`
+	monthSheetsTable = `create table if not exists month_sheets ("user_id" integer not null, "spreadsheet_id" text not null, "month" integer not null, "sheet_id" integer not null, primary key ("user_id", "spreadsheet_id", "month"))`
+	timesheetsTable  = `create table if not exists timesheets ("user_id" integer not null, "year" integer not null, "sheet_id" text not null, "sheet_url" text not null default '', primary key ("user_id", "year"))`
+	schedulesTable   = `create table if not exists schedules ("user_id" integer not null, "effective_from" text not null, "work_day" datetime, "extra_work_start" datetime, "schedule" text not null default '', primary key ("user_id", "effective_from"))`
+
+	schemaVersionTable = `create table if not exists schema_version ("version" integer not null primary key, "description" text, "applied_at" datetime)`
+)
+
+// migrations are applied in order. The up migrations must also work on the
+// databases created before migrations were introduced, whose tables were
+// created and altered as needed at startup. Never change a released
+// migration: append a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create the users table",
+		up: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(usersTableV1)
+			return err
+		},
+		down: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("drop table users")
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "Add the timesheet backends",
+		up: func(tx *sqlx.Tx) error {
+			// Users created before timesheet backends were introduced all
+			// use Google Sheets.
+			err := addColumnIfMissing(tx, "users", "backend", fmt.Sprintf("text not null default '%s'", types.GoogleSheets))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(recordsTable)
+			return err
+		},
+		down: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("drop table records")
+			if err != nil {
+				return err
+			}
+			return rebuildTable(tx, "users", usersTableV1, usersColumnsV1)
+		},
+	},
+	{
+		Version:     3,
+		Description: "Add the attendance ledger",
+		up: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(ledgerTable)
+			if err != nil {
+				return err
+			}
+			// The working hours of users created before the attendance
+			// ledger was introduced are imported from their timesheet on
+			// demand.
+			err = addColumnIfMissing(tx, "users", "ledger_start", fmt.Sprintf("datetime not null default '%s'", time.Time{}.Format(sqlite3.SQLiteTimestampFormats[0])))
+			if err != nil {
+				return err
+			}
+			return importRecords(tx)
+		},
+		down: func(tx *sqlx.Tx) error {
+			err := exportRecords(tx)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("drop table ledger")
+			if err != nil {
+				return err
+			}
+			return rebuildTable(tx, "users", usersTableV2, usersColumnsV2)
+		},
+	},
+	{
+		Version:     4,
+		Description: "Add the timesheet outbox",
+		up: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(outboxTable)
+			return err
+		},
+		down: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("drop table outbox")
+			return err
+		},
+	},
+	{
+		Version:     5,
+		Description: "Record who made the ledger events and the corrections",
+		up: func(tx *sqlx.Tx) error {
+			err := addColumnIfMissing(tx, "ledger", "recorded_by", "integer not null default 0")
+			if err != nil {
+				return err
+			}
+			// The events recorded so far were all made by the users
+			_, err = tx.Exec("update ledger set recorded_by = user_id")
+			if err != nil {
+				return err
+			}
+			return addColumnIfMissing(tx, "ledger", "replaces", "integer not null default 0")
+		},
+		down: func(tx *sqlx.Tx) error {
+			// Keep the corrected times only
+			_, err := tx.Exec("delete from ledger where " + replacedEvents)
+			if err != nil {
+				return err
+			}
+			return rebuildTable(tx, "ledger", ledgerTable, "id, user_id, kind, time, recorded_at")
+		},
+	},
+	{
+		Version:     6,
+		Description: "Add the scheduled digests",
+		up: func(tx *sqlx.Tx) error {
+			err := addColumnIfMissing(tx, "users", "digest", fmt.Sprintf("text not null default '%s'", types.NoDigest))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(digestsTable)
+			return err
+		},
+		down: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("drop table digests")
+			if err != nil {
+				return err
+			}
+			return rebuildTable(tx, "users", usersTableV3, usersColumnsV3)
+		},
+	},
+	{
+		Version:     7,
+		Description: "Add the reminders",
+		up: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(remindersTable)
+			return err
+		},
+		down: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("drop table reminders")
+			return err
+		},
+	},
+	{
+		Version:     8,
+		Description: "Add the end of day policies",
+		up: func(tx *sqlx.Tx) error {
+			err := addColumnIfMissing(tx, "users", "close_policy", fmt.Sprintf("text not null default '%s'", types.LeaveOpen))
+			if err != nil {
+				return err
+			}
+			return addColumnIfMissing(tx, "users", "close_time", fmt.Sprintf("datetime not null default '%s'", time.Time{}.Format(sqlite3.SQLiteTimestampFormats[0])))
+		},
+		down: func(tx *sqlx.Tx) error {
+			return rebuildTable(tx, "users", usersTableV4, usersColumnsV4)
+		},
+	},
+	{
+		Version:     9,
+		Description: "Add the weekly schedules",
+		up: func(tx *sqlx.Tx) error {
+			return addColumnIfMissing(tx, "users", "schedule", "text not null default ''")
+		},
+		down: func(tx *sqlx.Tx) error {
+			return rebuildTable(tx, "users", usersTableV5, usersColumnsV5)
+		},
+	},
+	{
+		Version:     10,
+		Description: "Add the languages",
+		up: func(tx *sqlx.Tx) error {
+			// The users and the spreadsheets created so far speak Italian
+			err := addColumnIfMissing(tx, "users", "language", fmt.Sprintf("text not null default '%s'", types.Italian))
+			if err != nil {
+				return err
+			}
+			return addColumnIfMissing(tx, "users", "sheet_language", fmt.Sprintf("text not null default '%s'", types.Italian))
+		},
+		down: func(tx *sqlx.Tx) error {
+			return rebuildTable(tx, "users", usersTableV6, usersColumnsV6)
+		},
+	},
+	{
+		Version:     11,
+		Description: "Add the month sheet IDs",
+		up: func(tx *sqlx.Tx) error {
+			// The sheets of the existing spreadsheets are found by title
+			// the first time they are accessed
+			_, err := tx.Exec(monthSheetsTable)
+			return err
+		},
+		down: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("drop table month_sheets")
+			return err
+		},
+	},
+	{
+		Version:     12,
+		Description: "Add the yearly timesheets",
+		up: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec(timesheetsTable)
+			if err != nil {
+				return err
+			}
+			// The existing spreadsheets have been receiving the punches of
+			// the current year, whatever year they were created in
+			_, err = tx.Exec(`insert into timesheets (user_id, year, sheet_id, sheet_url)
+				select id, cast(strftime('%Y', 'now') as integer), sheet_id, 'https://docs.google.com/spreadsheets/d/' || sheet_id
+				from users where backend = ? and sheet_id != ''`, types.GoogleSheets)
+			return err
+		},
+		down: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("drop table timesheets")
+			return err
+		},
+	},
+	{
+		Version:     13,
+		Description: "Add the schedule history",
+		up: func(tx *sqlx.Tx) error {
+			// The users without a history keep the settings stored in the
+			// users table, which apply to every day
+			_, err := tx.Exec(schedulesTable)
+			return err
+		},
+		down: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("drop table schedules")
+			return err
+		},
+	},
+	{
+		Version:     14,
+		Description: "Add the holiday calendars",
+		up: func(tx *sqlx.Tx) error {
+			// The holidays have been the Italian ones for everybody so far
+			return addColumnIfMissing(tx, "users", "holidays", fmt.Sprintf("text not null default '%s'", types.ItalianHolidays))
+		},
+		down: func(tx *sqlx.Tx) error {
+			return rebuildTable(tx, "users", usersTableV7, usersColumnsV7)
+		},
+	},
+}
+
+// LatestSchemaVersion returns the version of the schema this build of
+// WorkBot works with.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns the version of the schema of the user database.
+func SchemaVersion() (int, error) {
+	_, err := dbMap.Exec(schemaVersionTable)
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = dbMap.Dbx.Get(&version, "select max(version) from schema_version")
+	return int(version.Int64), err
+}
+
+// MigrationsStatus returns the status of all the known migrations.
+func MigrationsStatus() ([]MigrationStatus, error) {
+	_, err := dbMap.Exec(schemaVersionTable)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	err = dbMap.Dbx.Select(&applied, "select version, applied_at from schema_version")
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i].Migration = m
+		for _, a := range applied {
+			if a.Version == m.Version {
+				status[i].Applied = true
+				status[i].AppliedAt = a.AppliedAt
+			}
+		}
+	}
+	return status, nil
+}
+
+// MigrateUp applies the migrations up to the given version, each in its
+// own transaction, and returns the applied ones.
+func MigrateUp(to int) ([]Migration, error) {
+	current, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, newerSchemaError(current)
+	}
+	if to > LatestSchemaVersion() {
+		return nil, fmt.Errorf("userdb: unknown schema version %d", to)
+	}
+	if to < current {
+		return nil, fmt.Errorf("userdb: schema version %d is older than the current version %d", to, current)
+	}
+
+	var applied []Migration
+	for _, m := range migrations[current:to] {
+		err = migrate(m.up, "insert into schema_version (version, description, applied_at) values (?, ?, ?)",
+			m.Version, m.Description, time.Now().UTC())
+		if err != nil {
+			return applied, fmt.Errorf("userdb: migration %d: %s", m.Version, err.Error())
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the migrations down to the given version, each in its
+// own transaction, and returns the reverted ones.
+func MigrateDown(to int) ([]Migration, error) {
+	current, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, newerSchemaError(current)
+	}
+	if to < 0 {
+		return nil, fmt.Errorf("userdb: unknown schema version %d", to)
+	}
+	if to > current {
+		return nil, fmt.Errorf("userdb: schema version %d is newer than the current version %d", to, current)
+	}
+
+	var reverted []Migration
+	for i := current - 1; i >= to; i-- {
+		m := migrations[i]
+		err = migrate(m.down, "delete from schema_version where version = ?", m.Version)
+		if err != nil {
+			return reverted, fmt.Errorf("userdb: migration %d: %s", m.Version, err.Error())
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+func newerSchemaError(version int) error {
+	return fmt.Errorf("userdb: schema version %d is newer than the latest known version %d: upgrade WorkBot or migrate the database down with the newer build", version, LatestSchemaVersion())
+}
+
+// migrate runs f and records its outcome in the schema_version table with
+// query, in a single transaction.
+func migrate(f func(tx *sqlx.Tx) error, query string, args ...interface{}) error {
+	tx, err := dbMap.Dbx.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = f(tx)
+	if err == nil {
+		_, err = tx.Exec(query, args...)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func addColumnIfMissing(tx *sqlx.Tx, table string, column string, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("pragma table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			ctype     string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		err = rows.Scan(&cid, &name, &ctype, &notNull, &dfltValue, &pk)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, definition))
+	return err
+}
+
+// rebuildTable recreates table with the definition in create, keeping the
+// given columns. The bundled SQLite cannot drop columns.
+func rebuildTable(tx *sqlx.Tx, table string, create string, columns string) error {
+	_, err := tx.Exec(fmt.Sprintf("alter table %s rename to %s_old", table, table))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(create)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("insert into %s (%s) select %s from %s_old", table, columns, columns, table))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("drop table %s_old", table))
+	return err
+}
+
+// importRecords moves the records kept by the local timesheet backend
+// before the attendance ledger was introduced into the ledger.
+func importRecords(tx *sqlx.Tx) error {
+	var count int
+	err := tx.Get(&count, "select count(*) from sqlite_master where type = 'table' and name = 'records'")
+	if err != nil || count == 0 {
+		return err
+	}
+
+	var records []struct {
+		UserId int       `db:"user_id"`
+		Enter  time.Time `db:"enter_time"`
+		Exit   time.Time `db:"exit_time"`
+	}
+	err = tx.Select(&records, "select user_id, enter_time, exit_time from records order by id")
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		err = insertEvent(tx, types.NewEvent(r.UserId, types.EnterEvent, r.Enter))
+		if err == nil && !r.Exit.IsZero() {
+			err = insertEvent(tx, types.NewEvent(r.UserId, types.ExitEvent, r.Exit))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("drop table records")
+	return err
+}
+
+// exportRecords moves the working hours of the users of the local timesheet
+// backend back from the ledger into the records table.
+func exportRecords(tx *sqlx.Tx) error {
+	_, err := tx.Exec(recordsTable)
+	if err != nil {
+		return err
+	}
+
+	var events []struct {
+		types.Event
+		TimeZone string `db:"time_zone"`
+	}
+	err = tx.Select(&events, `select ledger.id, ledger.user_id, ledger.kind, ledger.time, ledger.recorded_at, users.time_zone
+		from ledger join users on users.id = ledger.user_id
+		where users.backend = ? order by ledger.user_id, ledger.time, ledger.id`, types.Local)
+	if err != nil {
+		return err
+	}
+
+	type record struct {
+		userId      int
+		date        string
+		enter, exit time.Time
+	}
+	var r *record
+	insert := func() error {
+		if r == nil {
+			return nil
+		}
+		_, err := tx.Exec("insert into records (user_id, date, enter_time, exit_time) values (?, ?, ?, ?)",
+			r.userId, r.date, r.enter, r.exit)
+		r = nil
+		return err
+	}
+
+	for _, e := range events {
+		if r != nil && (r.userId != e.UserId || e.Kind == types.EnterEvent) {
+			err = insert()
+			if err != nil {
+				return err
+			}
+		}
+
+		switch e.Kind {
+		case types.EnterEvent:
+			loc, err := time.LoadLocation(e.TimeZone)
+			if err != nil {
+				loc = time.UTC
+			}
+			r = &record{
+				userId: e.UserId,
+				date:   e.Time.In(loc).Format("2006-01-02"),
+				enter:  e.Time,
+			}
+		case types.ExitEvent:
+			if r != nil {
+				r.exit = e.Time
+			}
+		}
+	}
+	return insert()
+}
+
+func insertEvent(tx *sqlx.Tx, e *types.Event) error {
+	_, err := tx.Exec("insert into ledger (user_id, kind, time, recorded_at) values (?, ?, ?, ?)",
+		e.UserId, e.Kind, e.Time, e.RecordedAt)
+	return err
+}
@@ -0,0 +1,75 @@
+package userdb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// schema describes the tables of the database and their columns, leaving
+// out the bookkeeping of the migrations.
+func schema(t *testing.T) map[string]string {
+	t.Helper()
+	var tables []string
+	err := dbMap.Dbx.Select(&tables, "select name from sqlite_master where type = 'table' and name not like 'sqlite_%' and name != 'schema_version'")
+	if err != nil {
+		t.Fatalf("could not list the tables: %s", err)
+	}
+
+	s := make(map[string]string)
+	for _, table := range tables {
+		var columns []string
+		err = dbMap.Dbx.Select(&columns, "select name from pragma_table_info(?) order by cid", table)
+		if err != nil {
+			t.Fatalf("could not list the columns of %s: %s", table, err)
+		}
+		s[table] = strings.Join(columns, ",")
+	}
+	return s
+}
+
+func TestMigrations(t *testing.T) {
+	err := OpenUserDB(":memory:")
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	defer dbMap.Db.Close()
+
+	// Each migration reverted gets back the schema it was applied to
+	schemas := []map[string]string{schema(t)}
+	for version := 1; version <= LatestSchemaVersion(); version++ {
+		applied, err := MigrateUp(version)
+		if err != nil || len(applied) != 1 || applied[0].Version != version {
+			t.Fatalf("migration %d up: got %v, %v", version, applied, err)
+		}
+		schemas = append(schemas, schema(t))
+	}
+	for version := LatestSchemaVersion() - 1; version >= 0; version-- {
+		reverted, err := MigrateDown(version)
+		if err != nil || len(reverted) != 1 || reverted[0].Version != version+1 {
+			t.Fatalf("migration %d down: got %v, %v", version+1, reverted, err)
+		}
+		if got := schema(t); !reflect.DeepEqual(got, schemas[version]) {
+			t.Errorf("migration %d down: got schema %v, want %v", version+1, got, schemas[version])
+		}
+		if got, _ := SchemaVersion(); got != version {
+			t.Errorf("migration %d down: got version %d, want %d", version+1, got, version)
+		}
+	}
+
+	applied, err := MigrateUp(LatestSchemaVersion())
+	if err != nil || len(applied) != LatestSchemaVersion() {
+		t.Fatalf("all the migrations up: got %d applied, %v", len(applied), err)
+	}
+	if got := schema(t); !reflect.DeepEqual(got, schemas[LatestSchemaVersion()]) {
+		t.Errorf("all the migrations up: got schema %v, want %v", got, schemas[LatestSchemaVersion()])
+	}
+
+	// The versions out of range are refused
+	if _, err := MigrateUp(LatestSchemaVersion() + 1); err == nil {
+		t.Error("migration to an unknown version: got no error")
+	}
+	if _, err := MigrateDown(-1); err == nil {
+		t.Error("migration to a negative version: got no error")
+	}
+}
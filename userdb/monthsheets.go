@@ -0,0 +1,20 @@
+package userdb
+
+import (
+	"github.com/lnovara/workbot/types"
+)
+
+// GetMonthSheet retrieves the sheet of a month in a spreadsheet of a user
+func GetMonthSheet(userId int, spreadsheetId string, month int) (*types.MonthSheet, error) {
+	sheet := &types.MonthSheet{}
+	err := dbMap.Get(sheet, userId, spreadsheetId, month)
+	return sheet, err
+}
+
+// SaveMonthSheet inserts or updates the sheet of a month in a spreadsheet of
+// a user
+func SaveMonthSheet(sheet *types.MonthSheet) error {
+	_, err := dbMap.Exec("insert or replace into month_sheets (user_id, spreadsheet_id, month, sheet_id) values (?, ?, ?, ?)",
+		sheet.UserId, sheet.SpreadsheetId, sheet.Month, sheet.SheetId)
+	return err
+}
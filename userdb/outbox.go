@@ -0,0 +1,58 @@
+package userdb
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+// EnqueueSyncJob adds a sync job for the given user and month to the
+// outbox, unless one is already pending
+func EnqueueSyncJob(userId int, month string) error {
+	job := &types.SyncJob{}
+	err := dbMap.SelectOne(job, "select * from outbox where user_id = ? and month = ?", userId, month)
+	if err == nil {
+		// The pending job will write the whole month: just make it due now
+		job.NextAttempt = time.Now().UTC()
+		_, err = dbMap.Update(job)
+		return err
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	now := time.Now().UTC()
+	return dbMap.Insert(&types.SyncJob{
+		UserId:      userId,
+		Month:       month,
+		NextAttempt: now,
+		CreatedAt:   now,
+	})
+}
+
+// GetDueSyncJobs retrieves the sync jobs whose next attempt is due at now
+func GetDueSyncJobs(now time.Time) ([]types.SyncJob, error) {
+	var jobs []types.SyncJob
+	err := dbMap.Select(&jobs, "select * from outbox where next_attempt <= ? order by next_attempt, id", now.UTC())
+	return jobs, err
+}
+
+// RescheduleSyncJobs makes the pending sync jobs of a user due at t
+func RescheduleSyncJobs(userId int, t time.Time) error {
+	_, err := dbMap.Exec("update outbox set next_attempt = ? where user_id = ?", t.UTC(), userId)
+	return err
+}
+
+// UpdateSyncJob updates a sync job in the outbox
+func UpdateSyncJob(job *types.SyncJob) error {
+	_, err := dbMap.Update(job)
+	return err
+}
+
+// DeleteSyncJob removes a sync job from the outbox, unless it has been
+// enqueued again since it was retrieved: the month has changed meanwhile and
+// has to be written once more
+func DeleteSyncJob(job *types.SyncJob) error {
+	_, err := dbMap.Exec("delete from outbox where id = ? and next_attempt = ?", job.Id, job.NextAttempt.UTC())
+	return err
+}
@@ -0,0 +1,44 @@
+package userdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteSyncJobKeepsReenqueuedJob(t *testing.T) {
+	openTestDB(t)
+
+	err := EnqueueSyncJob(1, "2026-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := GetDueSyncJobs(time.Now())
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("got %d jobs, %v", len(jobs), err)
+	}
+
+	// A punch arrives while the month is being written
+	time.Sleep(time.Millisecond)
+	err = EnqueueSyncJob(1, "2026-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = DeleteSyncJob(&jobs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := GetDueSyncJobs(time.Now())
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("the job enqueued again has been deleted: got %d jobs, %v", len(pending), err)
+	}
+
+	err = DeleteSyncJob(&pending[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err = GetDueSyncJobs(time.Now())
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("got %d jobs after the delete, %v", len(pending), err)
+	}
+}
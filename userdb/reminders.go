@@ -0,0 +1,37 @@
+package userdb
+
+import (
+	"time"
+
+	"github.com/lnovara/workbot/types"
+)
+
+// GetUserIds retrieves the IDs of all the users
+func GetUserIds() ([]int, error) {
+	var ids []int
+	err := dbMap.Dbx.Select(&ids, "select id from users order by id")
+	return ids, err
+}
+
+// GetReminder retrieves a reminder sent to a user
+func GetReminder(userId int, name string) (*types.Reminder, error) {
+	reminder := &types.Reminder{}
+	err := dbMap.Get(reminder, userId, name)
+	return reminder, err
+}
+
+// SaveReminder inserts or updates a reminder sent to a user
+func SaveReminder(reminder *types.Reminder) error {
+	_, err := dbMap.Exec("insert or replace into reminders (user_id, name, sent_at, snoozed_until) values (?, ?, ?, ?)",
+		reminder.UserId, reminder.Name, reminder.SentAt.UTC(), reminder.SnoozedUntil.UTC())
+	return err
+}
+
+// GetSnoozedReminders retrieves the reminders of a user whose name starts
+// with prefix and that are due again at now
+func GetSnoozedReminders(userId int, prefix string, now time.Time) ([]types.Reminder, error) {
+	var reminders []types.Reminder
+	err := dbMap.Select(&reminders, "select * from reminders where user_id = ? and name like ? and snoozed_until > ? and snoozed_until <= ? order by name",
+		userId, prefix+"%", time.Time{}.UTC(), now.UTC())
+	return reminders, err
+}
@@ -0,0 +1,21 @@
+package userdb
+
+import (
+	"github.com/lnovara/workbot/types"
+)
+
+// GetWorkSchedules retrieves the history of the work day settings of a
+// user, from the oldest
+func GetWorkSchedules(userId int) ([]types.WorkSchedule, error) {
+	var schedules []types.WorkSchedule
+	err := dbMap.Dbx.Select(&schedules, "select * from schedules where user_id = ? order by effective_from", userId)
+	return schedules, err
+}
+
+// SaveWorkSchedule inserts or updates the work day settings of a user in
+// effect from a day on
+func SaveWorkSchedule(schedule *types.WorkSchedule) error {
+	_, err := dbMap.Exec("insert or replace into schedules (user_id, effective_from, work_day, extra_work_start, schedule) values (?, ?, ?, ?, ?)",
+		schedule.UserId, schedule.EffectiveFrom, schedule.WorkDay, schedule.ExtraWorkStart, schedule.Schedule)
+	return err
+}
@@ -0,0 +1,33 @@
+package userdb
+
+import (
+	"github.com/lnovara/workbot/types"
+)
+
+// GetTimesheet retrieves the timesheet of a user for a year
+func GetTimesheet(userId int, year int) (*types.Timesheet, error) {
+	timesheet := &types.Timesheet{}
+	err := dbMap.Get(timesheet, userId, year)
+	return timesheet, err
+}
+
+// GetLatestTimesheet retrieves the timesheet of a user for the latest year
+func GetLatestTimesheet(userId int) (*types.Timesheet, error) {
+	timesheet := &types.Timesheet{}
+	err := dbMap.Dbx.Get(timesheet, "select * from timesheets where user_id = ? order by year desc limit 1", userId)
+	return timesheet, err
+}
+
+// GetTimesheets retrieves the timesheets of a user, from the oldest
+func GetTimesheets(userId int) ([]types.Timesheet, error) {
+	var timesheets []types.Timesheet
+	err := dbMap.Dbx.Select(&timesheets, "select * from timesheets where user_id = ? order by year", userId)
+	return timesheets, err
+}
+
+// SaveTimesheet inserts or updates the timesheet of a user for a year
+func SaveTimesheet(timesheet *types.Timesheet) error {
+	_, err := dbMap.Exec("insert or replace into timesheets (user_id, year, sheet_id, sheet_url) values (?, ?, ?, ?)",
+		timesheet.UserId, timesheet.Year, timesheet.SheetId, timesheet.SheetUrl)
+	return err
+}
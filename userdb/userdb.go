@@ -5,35 +5,70 @@ import (
 
 	"github.com/jmoiron/modl"
 	"github.com/lnovara/workbot/types"
-	// Initialize sqlite3 driver
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
 	dbMap *modl.DbMap
 )
 
-// NewUserDB initializes a new database to hold users informations.
-func NewUserDB(dbFilePath string) error {
+// NewUserDB initializes a new database to hold users informations, applying
+// the pending schema migrations. It returns the applied migrations.
+func NewUserDB(dbFilePath string) ([]Migration, error) {
+	err := OpenUserDB(dbFilePath)
+	if err != nil {
+		return nil, err
+	}
+	// MigrateUp refuses to use a database migrated by a newer build
+	return MigrateUp(LatestSchemaVersion())
+}
+
+// OpenUserDB opens the database holding users informations as it is,
+// e.g. to migrate it.
+func OpenUserDB(dbFilePath string) error {
 	db, err := sql.Open("sqlite3", dbFilePath)
 	if err != nil {
 		return err
 	}
 
-	dbMap = modl.NewDbMap(db, modl.SqliteDialect{})
+	// SQLite does not support concurrent writes: serialize the accesses of
+	// the goroutines handling the updates
+	db.SetMaxOpenConns(1)
 
-	dbMap.AddTableWithName(types.User{}, "users").SetKeys(false, "Id")
+	dbMap = modl.NewDbMap(db, modl.SqliteDialect{})
 
-	err = dbMap.CreateTablesIfNotExists()
+	// The tables are created by the migrations
+	users := dbMap.AddTableWithName(types.User{}, "users").SetKeys(false, "Id")
+	// The client secret is refreshed concurrently with the handling of the
+	// user's updates: it is written only by UpdateClientSecret, so that
+	// UpdateUser does not overwrite it with a stale value.
+	users.ColMap("ClientSecret").SetTransient(true)
+	dbMap.AddTableWithName(types.Event{}, "ledger").SetKeys(true, "Id")
+	dbMap.AddTableWithName(types.SyncJob{}, "outbox").SetKeys(true, "Id")
+	dbMap.AddTableWithName(types.Reminder{}, "reminders").SetKeys(false, "user_id", "name")
+	dbMap.AddTableWithName(types.MonthSheet{}, "month_sheets").SetKeys(false, "user_id", "spreadsheet_id", "month")
+	dbMap.AddTableWithName(types.Timesheet{}, "timesheets").SetKeys(false, "user_id", "year")
 
-	return err
+	return nil
 }
 
 // GetUser retrieves a user from a userdb
 func GetUser(id int) (*types.User, error) {
 	user := &types.User{}
 	err := dbMap.Get(user, id)
-	return user, err
+	if err != nil {
+		return user, err
+	}
+	var clientSecret []byte
+	err = dbMap.Dbx.Get(&clientSecret, "select client_secret from users where id = ?", id)
+	if err != nil || len(clientSecret) == 0 {
+		return user, err
+	}
+	clientSecret, err = openSecret(encryptionKey, id, clientSecret)
+	if err != nil {
+		return user, err
+	}
+	user.ClientSecret = clientSecret
+	return user, nil
 }
 
 // InsertUser inserts a new user in a userdb
@@ -48,6 +83,29 @@ func UpdateUser(user *types.User) error {
 	return err
 }
 
+// UpdateClientSecret updates the client secret of a user in a userdb
+func UpdateClientSecret(id int, clientSecret []byte) error {
+	var value interface{}
+	if len(clientSecret) > 0 {
+		value = clientSecret
+		if encryptionKey != nil {
+			sealed, err := sealSecret(encryptionKey, id, clientSecret)
+			if err != nil {
+				return err
+			}
+			value = sealed
+		}
+	}
+	_, err := dbMap.Exec("update users set client_secret = ? where id = ?", value, id)
+	return err
+}
+
+// UpdateSheetId updates the timesheet of a user in a userdb
+func UpdateSheetId(id int, sheetId string) error {
+	_, err := dbMap.Exec("update users set sheet_id = ? where id = ?", sheetId, id)
+	return err
+}
+
 // DeleteUser delets a user in a userdb
 func DeleteUser(user *types.User) error {
 	_, err := dbMap.Delete(user)
@@ -0,0 +1,18 @@
+package userdb
+
+import (
+	"testing"
+)
+
+// openTestDB opens an empty database in memory, migrated to the latest
+// schema.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	_, err := NewUserDB(":memory:")
+	if err != nil {
+		t.Fatalf("could not open the database: %s", err)
+	}
+	t.Cleanup(func() {
+		dbMap.Db.Close()
+	})
+}